@@ -3,8 +3,10 @@ module github.com/hvossi92/gollama
 go 1.23.2
 
 require (
+	github.com/ledongthuc/pdf v0.0.0-20240201131950-da5b75280b06
 	github.com/philippgille/chromem-go v0.7.0
 	github.com/tursodatabase/go-libsql v0.0.0-20241221181756-6121e81fbf92
+	golang.org/x/net v0.34.0
 )
 
 require (
@@ -0,0 +1,44 @@
+// Command dedup removes duplicate chunks from an existing vector database, e.g. texts that were pasted twice
+// before chunks were deduplicated on ingestion. Of every set of chunks with the same normalized text, the
+// oldest one is kept. Stop the server before running it.
+//
+// Usage:
+//
+//	go run ./src/cmd/dedup -db gollama.db -dry-run
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/hvossi92/gollama/src/services"
+)
+
+func main() {
+	dbPath := flag.String("db", "gollama.db", "path of the database")
+	dryRun := flag.Bool("dry-run", false, "only count the duplicate chunks")
+	flag.Parse()
+
+	if _, err := os.Stat(*dbPath); err != nil {
+		log.Fatal(err)
+	}
+
+	vectorDB, err := services.SetUDatabaseService(*dbPath, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer vectorDB.Close()
+
+	count, err := vectorDB.DeduplicateChunks(*dryRun)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *dryRun {
+		fmt.Printf("Found %d duplicate chunks\n", count)
+	} else {
+		fmt.Printf("Removed %d duplicate chunks\n", count)
+	}
+}
@@ -0,0 +1,175 @@
+// Command vectorbench compares the DiskANN vector index with a brute-force scan of the vectors table
+// on synthetic embeddings. It works on a temporary database and does not need Ollama. Most of its runtime
+// is spent building the index while storing the chunks.
+//
+// Usage:
+//
+//	go run ./src/cmd/vectorbench -chunks 20000 -dimension 768 -queries 200
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hvossi92/gollama/src/services"
+)
+
+func main() {
+	chunks := flag.Int("chunks", 10000, "number of synthetic chunks to store")
+	dimension := flag.Int("dimension", 768, "embedding dimension")
+	queries := flag.Int("queries", 100, "number of queries per strategy")
+	topK := flag.Int("k", 3, "number of neighbours to retrieve")
+	seed := flag.Int64("seed", 1, "random seed")
+	flag.Parse()
+
+	for name, value := range map[string]int{"chunks": *chunks, "dimension": *dimension, "queries": *queries, "k": *topK} {
+		if value <= 0 {
+			log.Fatalf("-%s must be positive, but is %d", name, value)
+		}
+	}
+
+	dir, err := os.MkdirTemp("", "vectorbench")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	vectorDB, err := services.SetUDatabaseService(filepath.Join(dir, "bench.db"), true)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer vectorDB.Close()
+
+	var documentID int64
+	err = vectorDB.GetDB().QueryRow(`INSERT INTO documents (name, source, content_hash, content, chunk_size, chunk_overlap)
+		VALUES ('Synthetic chunks', 'benchmark', '', '', 0, 0) RETURNING id`).Scan(&documentID)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	random := rand.New(rand.NewSource(*seed))
+	embeddings := make([][]float32, *chunks)
+
+	for i := range embeddings {
+		embeddings[i] = randomVector(random, *dimension)
+	}
+
+	start := time.Now()
+	if err := store(vectorDB, documentID, embeddings); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Stored %d chunks of %d dimensions in %s\n", *chunks, *dimension, time.Since(start).Round(time.Millisecond))
+
+	// Queries are close to stored vectors, like a question is close to the chunk that answers it
+	queryEmbeddings := make([][]float32, *queries)
+	for i := range queryEmbeddings {
+		queryEmbeddings[i] = perturb(random, embeddings[random.Intn(len(embeddings))], 0.5)
+	}
+
+	options := services.RetrievalOptions{TopK: *topK, MaxDistance: 2}
+	exact := run(vectorDB, "brute force", queryEmbeddings, options, services.SearchBruteForce)
+	approximate := run(vectorDB, "vector index", queryEmbeddings, options, services.SearchIndexed)
+
+	// Recall: share of the exact nearest neighbours the index found as well
+	found, total := 0, 0
+	for i := range exact {
+		ids := make(map[int64]bool)
+		for _, item := range approximate[i] {
+			ids[item.ID] = true
+		}
+		for _, item := range exact[i] {
+			total++
+			if ids[item.ID] {
+				found++
+			}
+		}
+	}
+	if total > 0 {
+		fmt.Printf("Recall of the vector index: %.1f%%\n", 100*float64(found)/float64(total))
+	}
+}
+
+// store saves the embeddings as chunks of the given document. The first one goes through StoreChunkAndEmbedding,
+// which prepares the vectors table for the dimension, the rest is inserted in a single transaction.
+func store(vectorDB *services.VectorService, documentID int64, embeddings [][]float32) error {
+	err := vectorDB.StoreChunkAndEmbedding(documentID, "bench", "chunk 0", embeddings[0], "synthetic")
+	if err != nil {
+		return fmt.Errorf("failed to store chunk 0: %w", err)
+	}
+
+	tx, err := vectorDB.GetDB().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i := 1; i < len(embeddings); i++ {
+		vector, err := json.Marshal(embeddings[i])
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO vectors (document_id, title, text, embedding) VALUES (?, ?, ?, vector32(?))",
+			documentID, "bench", fmt.Sprintf("chunk %d", i), string(vector))
+		if err != nil {
+			return fmt.Errorf("failed to store chunk %d: %w", i, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// run answers all queries with the given strategy and prints the average latency.
+func run(vectorDB *services.VectorService, name string, queryEmbeddings [][]float32, options services.RetrievalOptions, strategy services.SearchStrategy) [][]services.VectorItem {
+	options.Strategy = strategy
+	results := make([][]services.VectorItem, len(queryEmbeddings))
+
+	start := time.Now()
+	for i, query := range queryEmbeddings {
+		items, err := vectorDB.FindSimilarVectors(query, options)
+		if err != nil {
+			log.Fatalf("%s search failed: %v", name, err)
+		}
+		results[i] = items
+	}
+	elapsed := time.Since(start)
+
+	fmt.Printf("%-12s %6d queries in %10s, %10s per query\n", name, len(queryEmbeddings),
+		elapsed.Round(time.Millisecond), (elapsed / time.Duration(len(queryEmbeddings))).Round(time.Microsecond))
+	return results
+}
+
+func randomVector(random *rand.Rand, dimension int) []float32 {
+	vector := make([]float32, dimension)
+	for i := range vector {
+		vector[i] = float32(random.NormFloat64())
+	}
+	return normalize(vector)
+}
+
+// perturb returns a normalized copy of the vector with gaussian noise of the given strength added.
+func perturb(random *rand.Rand, vector []float32, strength float64) []float32 {
+	noise := randomVector(random, len(vector))
+	result := make([]float32, len(vector))
+	for i := range vector {
+		result[i] = vector[i] + float32(strength)*noise[i]
+	}
+	return normalize(result)
+}
+
+func normalize(vector []float32) []float32 {
+	var sum float64
+	for _, value := range vector {
+		sum += float64(value) * float64(value)
+	}
+	norm := float32(math.Sqrt(sum))
+	for i := range vector {
+		vector[i] /= norm
+	}
+	return vector
+}
@@ -4,15 +4,21 @@ import (
 	"embed"
 	"fmt"
 	"html/template"
+	"io"
 	"io/fs"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/hvossi92/gollama/src/services"
 )
 
+// maxDocumentSize limits the size of documents uploaded to the vector database.
+const maxDocumentSize = 32 << 20 // 32 MB
+
 //go:embed templates
 var templatesFS embed.FS
 
@@ -21,11 +27,15 @@ var staticFS embed.FS
 
 // Server struct to hold all services and templates
 type Server struct {
-	templates     *template.Template
-	staticSubFS   fs.FS
-	uploadService *services.UploadService
-	vectorDB      *services.VectorService
-	ollamaService *services.OllamaService
+	templates      *template.Template
+	staticSubFS    fs.FS
+	uploadService  *services.UploadService
+	vectorDB       *services.VectorService
+	ollamaService  *services.OllamaService
+	streamService  *services.StreamService
+	reembedService *services.ReembedService
+	jobService     *services.JobService
+	embeddingCache *services.EmbeddingCache
 }
 
 // NewServer initializes and returns a new Server instance with all services set up.
@@ -53,15 +63,27 @@ func NewServer() (*Server, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to get settings: %w", err)
 	}
-	ollamaService := services.SetUpOllamaService(settings.URL, settings.LLM, settings.Embedding)
-	uploadService := services.SetUploadService(templates, ollamaService)
+	ollamaService, err := services.SetUpOllamaService(*settings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up LLM backend: %w", err)
+	}
+	ollamaService.ConfigureEmbeddingBatches(settings.EmbedBatch, settings.EmbedWorkers)
+	embeddingCache := services.SetUpEmbeddingCache(vectorDB, settings.EmbedCache)
+	ollamaService.SetEmbeddingCache(embeddingCache)
+	jobService := services.SetUpJobService(vectorDB, ollamaService)
+	uploadService := services.SetUploadService(templates, vectorDB, ollamaService, jobService)
+	uploadService.SetMaxImageSize(settings.MaxImageSize)
 
 	return &Server{
-		templates:     templates,
-		staticSubFS:   staticSubFS,
-		uploadService: uploadService,
-		vectorDB:      vectorDB,
-		ollamaService: ollamaService,
+		templates:      templates,
+		staticSubFS:    staticSubFS,
+		uploadService:  uploadService,
+		vectorDB:       vectorDB,
+		ollamaService:  ollamaService,
+		streamService:  services.SetUpStreamService(),
+		reembedService: services.SetUpReembedService(vectorDB, ollamaService),
+		jobService:     jobService,
+		embeddingCache: embeddingCache,
 	}, nil
 }
 
@@ -79,15 +101,34 @@ func main() {
 
 	http.HandleFunc("/", server.fetchIndexPage)
 	http.HandleFunc("POST /chat", server.fetchAiResponse)
+	http.HandleFunc("GET /chat/stream/{id}", server.streamAiResponse)
+	http.HandleFunc("GET /conversations/new", server.NewConversation)
+	http.HandleFunc("GET /conversations/{id}", server.GetConversation)
+	http.HandleFunc("PUT /conversations/{id}", server.RenameConversation)
+	http.HandleFunc("DELETE /conversations/{id}", server.DeleteConversation)
 	http.HandleFunc("POST /upload/image", server.uploadService.UploadAndSaveImage)
-	http.HandleFunc("GET /vector", server.GetVectors)
 	http.HandleFunc("POST /vector", server.UploadVector)
-	http.HandleFunc("GET /annotation-ui", server.uploadService.AnnotationUIHandler)
-	http.HandleFunc("POST /submit-annotations", server.uploadService.SubmitAnnotationsHandler)
+	http.HandleFunc("POST /vector/file", server.UploadVectorFile)
+	http.HandleFunc("GET /documents", server.ListDocuments)
+	http.HandleFunc("GET /documents/{id}", server.GetDocument)
+	http.HandleFunc("DELETE /documents/{id}", server.DeleteDocument)
+	http.HandleFunc("POST /documents/{id}/reindex", server.ReindexDocument)
+	http.HandleFunc("GET /jobs/{id}", server.GetJob)
+	http.HandleFunc("POST /jobs/{id}/cancel", server.CancelJob)
+	http.HandleFunc("GET /vector/reembed", server.GetReembedProgress)
+	http.HandleFunc("POST /vector/reembed", server.StartReembedding)
+	http.HandleFunc("GET /uploads/{id}", server.uploadService.ServeImage)
+	http.HandleFunc("GET /uploads/{id}/annotation-ui", server.uploadService.AnnotationUIHandler)
+	http.HandleFunc("POST /uploads/{id}/annotations", server.uploadService.SubmitAnnotationsHandler)
+	http.HandleFunc("POST /uploads/{id}/transcription", server.uploadService.TranscribeImageHandler)
 	http.HandleFunc("GET /cancel-annotation", server.uploadService.CancelAnnotationHandler)
 	http.HandleFunc("DELETE /upload", server.uploadService.PruneUploads)
+	http.HandleFunc("GET /analyses", server.ListImageAnalyses)
+	http.HandleFunc("GET /analyses/{id}", server.GetImageAnalysis)
+	http.HandleFunc("GET /analyses/{id}/thumbnail", server.GetImageAnalysisThumbnail)
+	http.HandleFunc("POST /analyses/{id}/embed", server.EmbedImageAnalysis)
+	http.HandleFunc("POST /settings/models", server.ListModels)
 	http.HandleFunc("PUT /settings", server.UpdateSettings)
-	http.Handle("/uploads/", http.StripPrefix("/uploads/", http.FileServer(http.Dir("./uploads"))))
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(server.staticSubFS))))
 
 	fmt.Println("Server listening on port 2048")
@@ -108,14 +149,28 @@ func (s *Server) fetchIndexPage(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	conversations, err := s.vectorDB.ListConversations()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cacheStats, err := s.embeddingCache.Stats()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	data := struct {
-		URL       string
-		LLM       string
-		Embedding string
+		services.Settings
+		Conversations []services.Conversation
+		ActiveID      int64
+		OOB           bool
+		Reembed       reembedProgress
+		CacheStats    services.EmbeddingCacheStats
 	}{
-		URL:       settings.URL,
-		LLM:       settings.LLM,
-		Embedding: settings.Embedding,
+		Settings:      *settings,
+		Conversations: conversations,
+		Reembed:       reembedProgress{ReembedStatus: s.reembedService.Status()},
+		CacheStats:    cacheStats,
 	}
 
 	err = s.templates.ExecuteTemplate(w, "index.html", data)
@@ -128,87 +183,1017 @@ func (s *Server) fetchAiResponse(w http.ResponseWriter, r *http.Request) {
 	message := r.FormValue("message")
 	doUseRag := r.URL.Query().Get("use-rag") == "true"
 
-	var err error
+	settings, err := s.vectorDB.GetSettings()
+	if err != nil {
+		http.Error(w, "failed to get settings: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	retrieval, err := retrievalOptions(r, settings)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	conversationID, history, err := s.prepareConversation(r.FormValue("conversation_id"), settings)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("stream") == "true" {
+		s.startAiResponseStream(w, message, doUseRag, retrieval, conversationID, history)
+		return
+	}
+
 	fmt.Println("Asking LLM")
-	aiResponse, err := s.ollamaService.AskLLM(message, doUseRag, s.vectorDB)
+	aiResponse, citations, err := s.ollamaService.AskLLM(message, doUseRag, s.vectorDB, retrieval, history)
 	if err != nil {
+		log.Printf("Failed to answer: %v\n", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		panic(err)
+		return
 	}
 	fmt.Printf("AI Response: %s", aiResponse)
 
+	conversationID, err = s.storeAnswer(conversationID, message, aiResponse)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	data := struct {
 		UserMessage string
 		AIResponse  string
+		Citations   []services.Citation
 	}{
 		UserMessage: message,
 		AIResponse:  aiResponse,
+		Citations:   citations,
 	}
 	err = s.templates.ExecuteTemplate(w, "message.html", data)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = s.writeConversationState(w, conversationID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// retrievalOptions returns the retrieval settings, overridden by the top_k, max_distance and
+// retrieval_mode parameters of the request if present.
+func retrievalOptions(r *http.Request, settings *services.Settings) (services.RetrievalOptions, error) {
+	options := settings.Retrieval()
+	if topK := r.FormValue("top_k"); topK != "" {
+		value, err := strconv.Atoi(topK)
+		if err != nil {
+			return options, fmt.Errorf("invalid top_k %q", topK)
+		}
+		options.TopK = value
+	}
+	if maxDistance := r.FormValue("max_distance"); maxDistance != "" {
+		value, err := strconv.ParseFloat(maxDistance, 64)
+		if err != nil {
+			return options, fmt.Errorf("invalid max_distance %q", maxDistance)
+		}
+		options.MaxDistance = value
 	}
+	if mode := r.FormValue("retrieval_mode"); mode != "" {
+		options.Mode = services.RetrievalMode(mode)
+	}
+	return options, options.Validate()
+}
+
+// prepareConversation resolves the conversation of a chat question and loads the history to replay within the
+// configured budget. A new conversation (id 0) has no history; it is only created together with the first answer,
+// see storeAnswer.
+func (s *Server) prepareConversation(rawConversationID string, settings *services.Settings) (int64, []services.ChatMessage, error) {
+	conversationID, err := parseID(rawConversationID)
+	if err != nil || conversationID == 0 {
+		return 0, nil, err
+	}
+
+	history, err := s.vectorDB.GetConversationHistory(conversationID, settings.HistoryTurns, settings.HistoryTokens)
+	if err != nil {
+		return 0, nil, err
+	}
+	return conversationID, history, nil
 }
 
-func (s *Server) GetVectors(w http.ResponseWriter, r *http.Request) {
-	text, err := s.vectorDB.ReadAllVectors()
+// storeAnswer stores a question together with its answer and returns the id of their conversation. Without a
+// conversation (id 0), a new one titled after the question is started. The question is only stored together with
+// its answer, so a failed answer leaves neither an unanswered question nor an empty conversation behind.
+func (s *Server) storeAnswer(conversationID int64, question string, answer string) (int64, error) {
+	messages := []services.ChatMessage{{Role: "user", Content: question}, {Role: "assistant", Content: answer}}
+	if conversationID != 0 {
+		return conversationID, s.vectorDB.AddMessages(conversationID, messages...)
+	}
+	conversation, err := s.vectorDB.StartConversation(titleFromText(question, "New conversation"), messages...)
+	if err != nil {
+		return 0, err
+	}
+	return conversation.ID, nil
+}
+
+// titleFromText derives a short title from the start of a text, e.g. the first question of a conversation.
+func titleFromText(text string, fallback string) string {
+	const maxTitleLength = 40
+
+	title := strings.Join(strings.Fields(text), " ")
+	if len([]rune(title)) > maxTitleLength {
+		title = string([]rune(title)[:maxTitleLength-3]) + "..."
+	}
+	if title == "" {
+		title = fallback
+	}
+	return title
+}
+
+// startAiResponseStream registers the question and renders a message fragment that connects to
+// the event stream of the answer.
+func (s *Server) startAiResponseStream(w http.ResponseWriter, message string, doUseRag bool, retrieval services.RetrievalOptions, conversationID int64, history []services.ChatMessage) {
+	stream, err := s.streamService.Create(message, doUseRag, retrieval, conversationID, history)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	data := struct {
 		UserMessage string
-		AIResponse  string
+		StreamID    string
 	}{
-		UserMessage: "Get all vectors",
-		AIResponse:  text,
+		UserMessage: message,
+		StreamID:    stream.ID,
 	}
-	err = s.templates.ExecuteTemplate(w, "message.html", data)
+	err = s.templates.ExecuteTemplate(w, "message-stream.html", data)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = s.writeConversationState(w, conversationID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// streamAiResponse answers a registered question and pushes the answer token by token
+// to the browser as Server-Sent Events.
+func (s *Server) streamAiResponse(w http.ResponseWriter, r *http.Request) {
+	stream, ok := s.streamService.Take(r.PathValue("id"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	fmt.Println("Streaming LLM answer")
+	aiResponse, citations, err := s.ollamaService.StreamLLM(r.Context(), stream.Question, stream.UseRag, s.vectorDB, stream.Retrieval, stream.History, func(token string) error {
+		if err := writeServerSentEvent(w, "token", template.HTMLEscapeString(token)); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	})
+	if err == nil {
+		var conversationID int64
+		conversationID, err = s.storeAnswer(stream.ConversationID, stream.Question, aiResponse)
+		if err == nil {
+			// A new conversation only exists now, so the page learns its id from the stream
+			var sb strings.Builder
+			if err := s.writeConversationState(&sb, conversationID); err != nil {
+				fmt.Println(err.Error())
+			} else {
+				writeServerSentEvent(w, "conversation", sb.String())
+			}
+		}
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+		writeServerSentEvent(w, "error", template.HTMLEscapeString(err.Error()))
+	}
+
+	if len(citations) > 0 {
+		var sb strings.Builder
+		if err := s.templates.ExecuteTemplate(&sb, "citations.html", citations); err != nil {
+			fmt.Println(err.Error())
+		} else {
+			writeServerSentEvent(w, "citations", sb.String())
+		}
+	}
+
+	writeServerSentEvent(w, "done", "")
+	flusher.Flush()
+}
+
+// writeServerSentEvent writes a single event, splitting multi-line data into several data fields.
+func writeServerSentEvent(w http.ResponseWriter, event string, data string) error {
+	var sb strings.Builder
+	sb.WriteString("event: " + event + "\n")
+	for _, line := range strings.Split(data, "\n") {
+		sb.WriteString("data: " + line + "\n")
 	}
+	sb.WriteString("\n")
+
+	_, err := w.Write([]byte(sb.String()))
+	return err
 }
 
 func (s *Server) UploadVector(w http.ResponseWriter, r *http.Request) {
 	text := r.FormValue("vectors")
-	if text == "" {
+	if strings.TrimSpace(text) == "" {
 		http.Error(w, "No data was provided", http.StatusBadRequest)
 		return
 	}
 
-	chunkedText, err := s.vectorDB.ChunkText(strings.TrimSpace(text), 16, 4) // Chunk text first
+	options, err := chunkOptions(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	for _, chunk := range chunkedText { // Iterate through each text chunk
+	name := titleFromText(text, "Pasted text")
+	job, err := s.jobService.SubmitIngestion(name, "paste", strings.TrimSpace(text), options)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.renderSubmittedJob(w, "Upload pasted text", job)
+}
+
+// UploadVectorFile adds an uploaded document (txt, md, html or pdf) to the vector database.
+func (s *Server) UploadVectorFile(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxDocumentSize)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "No valid file was provided: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-		embeddings, err := s.ollamaService.GetVectorEmbedding(chunk) // Get embedding for each chunk
+	text, err := services.ExtractDocumentText(header.Filename, content)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	options, err := chunkOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
+	filename := filepath.Base(header.Filename)
+	job, err := s.jobService.SubmitIngestion(filename, "upload", text, options)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.renderSubmittedJob(w, "Upload "+filename, job)
+}
+
+// chunkOptions reads the chunking strategy, size and overlap of an upload. Missing values fall back
+// to the defaults of the strategy, which itself defaults to sentence chunking.
+func chunkOptions(r *http.Request) (services.ChunkOptions, error) {
+	options := services.DefaultChunkOptions(services.ChunkStrategy(r.FormValue("chunk_strategy")))
+	if strategy := r.FormValue("chunk_strategy"); strategy != "" && services.ChunkStrategy(strategy) != options.Strategy {
+		return options, fmt.Errorf("unknown chunking strategy %q", strategy)
+	}
+
+	if size := r.FormValue("chunk_size"); size != "" {
+		value, err := strconv.Atoi(size)
+		if err != nil {
+			return options, fmt.Errorf("invalid chunk size %q", size)
+		}
+		options.Size = value
+		if options.Overlap >= options.Size {
+			options.Overlap = options.Size / 4
+		}
+	}
+	if overlap := r.FormValue("chunk_overlap"); overlap != "" {
+		value, err := strconv.Atoi(overlap)
+		if err != nil {
+			return options, fmt.Errorf("invalid chunk overlap %q", overlap)
+		}
+		options.Overlap = value
+	}
+
+	_, err := services.NewChunker(options)
+	return options, err
+}
+
+// renderSubmittedJob shows an upload in the chat, followed by the progress of its ingestion job.
+func (s *Server) renderSubmittedJob(w http.ResponseWriter, userMessage string, job *services.Job) {
+	data := struct {
+		UserMessage string
+		Job         *services.Job
+	}{
+		UserMessage: userMessage,
+		Job:         job,
+	}
+	err := s.templates.ExecuteTemplate(w, "job-submitted.html", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// GetJob renders the progress of an ingestion job, polled by the job fragment while the job is active.
+// Once the job has finished, the documents panel and, if it is shown, a re-indexed document are refreshed out of band.
+func (s *Server) GetJob(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.writeJob(w, id)
+}
+
+// CancelJob cancels a queued or running ingestion job and renders its new state.
+func (s *Server) CancelJob(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.jobService.Cancel(id); err != nil {
+		log.Printf("Failed to cancel job %d: %v\n", id, err)
+	}
+	s.writeJob(w, id)
+}
+
+func (s *Server) writeJob(w http.ResponseWriter, id int64) {
+	job, err := s.jobService.Get(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	err = s.templates.ExecuteTemplate(w, "job.html", job)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if job.Status == services.JobDone {
+		err = s.writeDocumentList(w, true)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-
-		err = s.vectorDB.StoreChunkAndEmbedding(chunk, embeddings) // Store chunk and embedding in DB
+	}
+	if job.Status == services.JobDone && job.ReindexID != 0 {
+		err = s.writeDocument(w, job.ReindexID, true)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// ListDocuments renders the documents panel.
+func (s *Server) ListDocuments(w http.ResponseWriter, r *http.Request) {
+	err := s.writeDocumentList(w, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// GetDocument renders the details and chunks of a document.
+func (s *Server) GetDocument(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = s.writeDocument(w, id, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+	}
+}
+
+func (s *Server) writeDocument(w http.ResponseWriter, id int64, oob bool) error {
+	document, err := s.vectorDB.GetDocument(id)
+	if err != nil {
+		return err
+	}
+	chunks, err := s.vectorDB.GetDocumentChunks(id)
+	if err != nil {
+		return err
+	}
+
+	data := struct {
+		Document *services.Document
+		Chunks   []services.VectorItem
+		OOB      bool
+	}{
+		Document: document,
+		Chunks:   chunks,
+		OOB:      oob,
+	}
+	return s.templates.ExecuteTemplate(w, "document.html", data)
+}
+
+// DeleteDocument deletes a document and its chunks from the vector database.
+func (s *Server) DeleteDocument(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = s.vectorDB.DeleteDocument(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = s.writeDocumentList(w, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// ReindexDocument queues a document to be chunked and embedded again, replacing its chunks. Without chunk options
+// in the request, the document keeps the ones it was indexed with. The progress is shown like for uploads.
+func (s *Server) ReindexDocument(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var options services.ChunkOptions
+	if r.FormValue("chunk_strategy") != "" {
+		options, err = chunkOptions(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 	}
+
+	job, err := s.jobService.SubmitReindex(id, options)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.renderSubmittedJob(w, "Re-index "+job.Name, job)
+}
+
+func (s *Server) writeDocumentList(w http.ResponseWriter, oob bool) error {
+	documents, err := s.vectorDB.ListDocuments()
+	if err != nil {
+		return err
+	}
+
+	data := struct {
+		Documents []services.Document
+		OOB       bool
+	}{
+		Documents: documents,
+		OOB:       oob,
+	}
+	return s.templates.ExecuteTemplate(w, "documents.html", data)
 }
 
+// ListImageAnalyses renders the gallery of the past image analyses of the session, filtered by the search query q.
+func (s *Server) ListImageAnalyses(w http.ResponseWriter, r *http.Request) {
+	analyses, err := s.vectorDB.ListImageAnalyses(services.RequestSession(r), r.FormValue("q"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = s.templates.ExecuteTemplate(w, "image-analyses.html", analyses)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// GetImageAnalysis renders the question, marked areas and answer of a past image analysis.
+func (s *Server) GetImageAnalysis(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	analysis, err := s.vectorDB.GetImageAnalysis(services.RequestSession(r), id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	err = s.templates.ExecuteTemplate(w, "image-analysis.html", analysis)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// GetImageAnalysisThumbnail serves the thumbnail kept with an image analysis.
+func (s *Server) GetImageAnalysisThumbnail(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	thumbnail, err := s.vectorDB.GetImageAnalysisThumbnail(services.RequestSession(r), id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if thumbnail == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Write(thumbnail)
+}
+
+// EmbedImageAnalysis adds a past image analysis to the vector database, so RAG chats can refer to it.
+func (s *Server) EmbedImageAnalysis(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	analysis, err := s.vectorDB.GetImageAnalysis(services.RequestSession(r), id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	job, err := s.jobService.SubmitImageAnalysis(analysis)
+	if err != nil {
+		s.renderAlert(w, "warning", "Not added: "+err.Error())
+		return
+	}
+	s.renderSubmittedJob(w, "Add "+analysis.DocumentName()+" to the knowledge base", job)
+}
+
+// modelPicker is the data of the model-picker.html fragment. Without a model list, e.g. if the backend can't be
+// reached, it falls back to free-text inputs for the model names.
+type modelPicker struct {
+	LLM          string
+	Embedding    string
+	VisionModel  string
+	Chat         modelSelect
+	Embeddings   modelSelect
+	VisionModels modelSelect
+	Error        string
+}
+
+// modelSelect is a dropdown of models, which lists the models with the wanted capability first.
+type modelSelect struct {
+	Name        string
+	Label       string
+	GroupLabel  string
+	Optional    string // Label of the empty option, if no model may be selected
+	Missing     string // Selected model that the backend doesn't offer
+	Recommended []modelOption
+	Other       []modelOption
+}
+
+type modelOption struct {
+	Name     string
+	Hint     string // Capabilities and size of the model
+	Selected bool
+}
+
+func newModelSelect(name string, label string, groupLabel string, models []services.Model, selected string, capability services.ModelCapability) modelSelect {
+	modelSelect := modelSelect{Name: name, Label: label, GroupLabel: groupLabel}
+	if _, ok := services.FindModel(models, selected); !ok && selected != "" {
+		modelSelect.Missing = selected
+	}
+
+	for _, model := range models {
+		hints := make([]string, 0, 3)
+		for _, modelCapability := range model.Capabilities() {
+			hints = append(hints, string(modelCapability))
+		}
+		if model.Details.ParameterSize != "" {
+			hints = append(hints, model.Details.ParameterSize)
+		}
+
+		_, isSelected := services.FindModel([]services.Model{model}, selected)
+		option := modelOption{Name: model.Name, Hint: strings.Join(hints, ", "), Selected: isSelected}
+		if model.Supports(capability) {
+			modelSelect.Recommended = append(modelSelect.Recommended, option)
+		} else {
+			modelSelect.Other = append(modelSelect.Other, option)
+		}
+	}
+	return modelSelect
+}
+
+// ListModels renders dropdowns of the models offered by the provider and URL entered in the settings form,
+// which don't have to be saved yet. The current selection of the form is kept. The form is posted, so an API key
+// entered in it doesn't end up in the URL or access logs.
+func (s *Server) ListModels(w http.ResponseWriter, r *http.Request) {
+	stored, err := s.vectorDB.GetSettings()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	settings := *stored
+	if provider := r.FormValue("provider"); provider != "" {
+		settings.Provider = services.ProviderKind(provider)
+	}
+	if url := strings.TrimSpace(r.FormValue("url")); url != "" {
+		settings.URL = url
+	}
+	settings.APIKey = submittedAPIKey(r, settings, stored)
+	if llm := strings.TrimSpace(r.FormValue("llm")); llm != "" {
+		settings.LLM = llm
+	}
+	if embedding := strings.TrimSpace(r.FormValue("embedding")); embedding != "" {
+		settings.Embedding = embedding
+	}
+	if r.Form.Has("vision_model") {
+		settings.VisionModel = strings.TrimSpace(r.FormValue("vision_model"))
+	}
+
+	data := modelPicker{LLM: settings.LLM, Embedding: settings.Embedding, VisionModel: settings.VisionModel}
+	models, err := s.ollamaService.ListModelsFor(settings)
+	if err != nil {
+		data.Error = err.Error()
+	} else {
+		data.Chat = newModelSelect("llm", "LLM", "Chat models", models, settings.LLM, services.CapabilityChat)
+		data.Embeddings = newModelSelect("embedding", "Embedding Model", "Embedding models", models, settings.Embedding, services.CapabilityEmbedding)
+		data.VisionModels = newModelSelect("vision_model", "Vision Model", "Vision models", models, settings.VisionModel, services.CapabilityVision)
+		data.VisionModels.Optional = "None (no image analysis)"
+	}
+
+	err = s.templates.ExecuteTemplate(w, "model-picker.html", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// submittedAPIKey returns the API key entered in the settings form. The stored key is never sent to the browser,
+// so an empty field keeps it, unless it is to be removed. It is only kept for the provider and URL it was stored
+// with, so a form can't send it to another server without the key being entered again.
+func submittedAPIKey(r *http.Request, settings services.Settings, stored *services.Settings) string {
+	if r.FormValue("clear_api_key") != "" {
+		return ""
+	}
+	if apiKey := strings.TrimSpace(r.FormValue("api_key")); apiKey != "" {
+		return apiKey
+	}
+	if settings.Provider != stored.Provider || settings.URL != stored.URL {
+		return ""
+	}
+	return stored.APIKey
+}
+
+// UpdateSettings validates the submitted settings against the LLM backend, stores them and applies them
+// to the running OllamaService. Problems are reported as an alert fragment in the settings form, doubts about
+// the vision model as a warning below the confirmation.
 func (s *Server) UpdateSettings(w http.ResponseWriter, r *http.Request) {
-	err := s.vectorDB.UpdateSettings(r.FormValue("url"), r.FormValue("llm"), r.FormValue("embedding"))
+	historyTurns, err := strconv.Atoi(r.FormValue("history_turns"))
+	if err != nil || historyTurns < 0 {
+		s.renderAlert(w, "danger", "History turns must be a non-negative number")
+		return
+	}
+	historyTokens, err := strconv.Atoi(r.FormValue("history_tokens"))
+	if err != nil || historyTokens < 0 {
+		s.renderAlert(w, "danger", "History tokens must be a non-negative number")
+		return
+	}
+
+	topK, err := strconv.Atoi(r.FormValue("top_k"))
+	if err != nil {
+		s.renderAlert(w, "danger", "Top-k must be a number")
+		return
+	}
+	maxDistance, err := strconv.ParseFloat(r.FormValue("max_distance"), 64)
+	if err != nil {
+		s.renderAlert(w, "danger", "Maximum distance must be a number")
+		return
+	}
+	embedBatch, err := strconv.Atoi(r.FormValue("embed_batch_size"))
+	if err != nil || embedBatch < 1 {
+		s.renderAlert(w, "danger", "Embedding batch size must be a positive number")
+		return
+	}
+	embedWorkers, err := strconv.Atoi(r.FormValue("embed_workers"))
+	if err != nil || embedWorkers < 1 {
+		s.renderAlert(w, "danger", "Parallel embedding requests must be a positive number")
+		return
+	}
+	embedCache, err := strconv.Atoi(r.FormValue("embed_cache_size"))
+	if err != nil || embedCache < 0 {
+		s.renderAlert(w, "danger", "Embedding cache size must be 0 or more")
+		return
+	}
+	maxImageSize, err := strconv.Atoi(r.FormValue("max_image_size"))
+	if err != nil || maxImageSize < 1 {
+		s.renderAlert(w, "danger", "Maximum image size must be a positive number of MB")
+		return
+	}
+
+	settings := services.Settings{
+		Provider:      services.ProviderKind(r.FormValue("provider")),
+		URL:           strings.TrimSpace(r.FormValue("url")),
+		LLM:           strings.TrimSpace(r.FormValue("llm")),
+		Embedding:     strings.TrimSpace(r.FormValue("embedding")),
+		VisionModel:   strings.TrimSpace(r.FormValue("vision_model")),
+		HistoryTurns:  historyTurns,
+		HistoryTokens: historyTokens,
+		TopK:          topK,
+		MaxDistance:   maxDistance,
+		RetrievalMode: services.RetrievalMode(r.FormValue("retrieval_mode")),
+		EmbedBatch:    embedBatch,
+		EmbedWorkers:  embedWorkers,
+		EmbedCache:    embedCache,
+		MaxImageSize:  maxImageSize,
+	}
+	if err := settings.Retrieval().Validate(); err != nil {
+		s.renderAlert(w, "danger", "Settings not saved: "+err.Error())
+		return
+	}
+
+	stored, err := s.vectorDB.GetSettings()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	settings.APIKey = submittedAPIKey(r, settings, stored)
+
+	reembed := s.reembedService.Status()
+	if reembed.Running && settings.Embedding != reembed.Model {
+		s.renderAlert(w, "danger", "Settings not saved: the vector database is still being re-embedded with "+reembed.Model)
+		return
+	}
+
+	warning, err := s.ollamaService.ValidateSettings(settings)
+	if err != nil {
+		s.renderAlert(w, "danger", "Settings not saved: "+err.Error())
+		return
+	}
+
+	err = s.vectorDB.UpdateSettings(settings)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = s.ollamaService.Configure(settings)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.ollamaService.ConfigureEmbeddingBatches(settings.EmbedBatch, settings.EmbedWorkers)
+	s.embeddingCache.SetLimit(settings.EmbedCache)
+	s.uploadService.SetMaxImageSize(settings.MaxImageSize)
+
+	// Stored vectors of another embedding model are useless for retrieval, so rebuild them
+	needsReembedding, err := s.vectorDB.NeedsReembedding(settings.Embedding)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if needsReembedding && !reembed.Running {
+		err = s.reembedService.Start()
+		if err != nil {
+			s.renderAlert(w, "danger", err.Error())
+			return
+		}
+		s.renderAlert(w, "success", "Settings updated, re-embedding the vector database with "+settings.Embedding)
+		s.renderReembedProgress(w, true)
+	} else {
+		s.renderAlert(w, "success", "Settings updated")
+	}
+	if warning != "" {
+		s.renderAlert(w, "warning", warning)
+	}
+}
+
+// GetReembedProgress renders the progress of the running re-embedding, polled by the progress fragment.
+func (s *Server) GetReembedProgress(w http.ResponseWriter, r *http.Request) {
+	s.renderReembedProgress(w, false)
+}
+
+// StartReembedding re-embeds the vector database with the configured embedding model, e.g. after a failed run.
+func (s *Server) StartReembedding(w http.ResponseWriter, r *http.Request) {
+	needsReembedding, err := s.vectorDB.NeedsReembedding(s.ollamaService.EmbeddingModel())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if needsReembedding {
+		err = s.reembedService.Start()
+		if err != nil {
+			s.renderAlert(w, "danger", err.Error())
+			return
+		}
+	}
+	s.renderReembedProgress(w, false)
+}
+
+// reembedProgress is the data of the reembed-progress.html fragment.
+type reembedProgress struct {
+	services.ReembedStatus
+	OOB bool
+}
+
+func (s *Server) renderReembedProgress(w http.ResponseWriter, oob bool) {
+	data := reembedProgress{
+		ReembedStatus: s.reembedService.Status(),
+		OOB:           oob,
+	}
+	err := s.templates.ExecuteTemplate(w, "reembed-progress.html", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// renderAlert renders a Bootstrap alert fragment. It is sent with status 200, so htmx swaps it into the target.
+func (s *Server) renderAlert(w http.ResponseWriter, level string, message string) {
+	data := struct {
+		Level   string
+		Message string
+	}{
+		Level:   level,
+		Message: message,
+	}
+	err := s.templates.ExecuteTemplate(w, "alert.html", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// NewConversation resets the chat to an empty, not yet persisted conversation.
+func (s *Server) NewConversation(w http.ResponseWriter, r *http.Request) {
+	err := s.renderConversation(w, 0, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// GetConversation loads all messages of a conversation into the chat.
+func (s *Server) GetConversation(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	messages, err := s.vectorDB.GetConversationMessages(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = s.renderConversation(w, id, messages)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// RenameConversation renames a conversation, taking the new title from the htmx prompt.
+func (s *Server) RenameConversation(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	title := strings.TrimSpace(r.Header.Get("HX-Prompt"))
+	if title == "" {
+		title = strings.TrimSpace(r.FormValue("title"))
+	}
+	if title == "" {
+		http.Error(w, "No title was provided", http.StatusBadRequest)
+		return
+	}
+
+	err = s.vectorDB.RenameConversation(id, title)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	activeID, _ := parseID(r.FormValue("conversation_id"))
+	err = s.writeConversationList(w, activeID, false)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// DeleteConversation deletes a conversation and resets the chat if it was the active one.
+func (s *Server) DeleteConversation(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	_, err = w.Write([]byte("Settings updated"))
+	err = s.vectorDB.DeleteConversation(id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+
+	activeID, _ := parseID(r.FormValue("conversation_id"))
+	if activeID == id {
+		activeID = 0
+	}
+	err = s.writeConversationList(w, activeID, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if activeID == 0 {
+		// The active conversation is gone, so also clear the chat out of band
+		data := struct {
+			ID       int64
+			Messages []services.ChatMessage
+			OOB      bool
+		}{OOB: true}
+		err = s.templates.ExecuteTemplate(w, "conversation.html", data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		err = s.templates.ExecuteTemplate(w, "conversation-id.html", activeID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// renderConversation renders the messages of a conversation plus the out-of-band conversation state.
+func (s *Server) renderConversation(w http.ResponseWriter, id int64, messages []services.ChatMessage) error {
+	data := struct {
+		ID       int64
+		Messages []services.ChatMessage
+		OOB      bool
+	}{
+		ID:       id,
+		Messages: messages,
+	}
+	err := s.templates.ExecuteTemplate(w, "conversation.html", data)
+	if err != nil {
+		return err
+	}
+	return s.writeConversationState(w, id)
+}
+
+// writeConversationState renders out-of-band updates for the active conversation id and the conversation list.
+func (s *Server) writeConversationState(w io.Writer, activeID int64) error {
+	err := s.templates.ExecuteTemplate(w, "conversation-id.html", activeID)
+	if err != nil {
+		return err
+	}
+	return s.writeConversationList(w, activeID, true)
+}
+
+func (s *Server) writeConversationList(w io.Writer, activeID int64, oob bool) error {
+	conversations, err := s.vectorDB.ListConversations()
+	if err != nil {
+		return err
+	}
+
+	data := struct {
+		Conversations []services.Conversation
+		ActiveID      int64
+		OOB           bool
+	}{
+		Conversations: conversations,
+		ActiveID:      activeID,
+		OOB:           oob,
+	}
+	return s.templates.ExecuteTemplate(w, "conversations.html", data)
+}
+
+// parseID parses a numeric id from a form or path value. An empty value yields 0.
+func parseID(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || id < 0 {
+		return 0, fmt.Errorf("invalid id %q", value)
+	}
+	return id, nil
 }
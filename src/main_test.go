@@ -0,0 +1,468 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hvossi92/gollama/src/services"
+)
+
+// newTestServer creates a server with a fresh database, talking to the Ollama API at ollamaURL.
+func newTestServer(t *testing.T, ollamaURL string) *Server {
+	t.Helper()
+	templates, err := template.ParseFS(templatesFS, "templates/*.html", "templates/**/*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vectorDB, err := services.SetUDatabaseService(filepath.Join(t.TempDir(), "test.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { vectorDB.Close() })
+
+	ollamaService, err := services.SetUpOllamaService(services.Settings{
+		Provider: services.ProviderOllama, URL: ollamaURL, LLM: "test-llm", Embedding: "test-embedding",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Server{
+		templates:     templates,
+		vectorDB:      vectorDB,
+		ollamaService: ollamaService,
+		streamService: services.SetUpStreamService(),
+	}
+}
+
+// fakeBackend is a fake LLM backend answering requests by path with fixed bodies and recording them. The
+// lines of a body are flushed one by one, like a streamed answer. Paths without a body are answered with 404.
+type fakeBackend struct {
+	*httptest.Server
+	responses map[string]string
+	status    int           // Status of the answers, http.StatusOK if not set
+	delay     time.Duration // Added before every answer, cut short if the client gives up
+
+	mu       sync.Mutex
+	requests []fakeRequest
+}
+
+type fakeRequest struct {
+	Path          string
+	Authorization string
+	Body          string
+}
+
+func newFakeBackend(t *testing.T, responses map[string]string) *fakeBackend {
+	t.Helper()
+	backend := &fakeBackend{responses: responses}
+	backend.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		backend.mu.Lock()
+		backend.requests = append(backend.requests, fakeRequest{Path: r.URL.Path, Authorization: r.Header.Get("Authorization"), Body: string(body)})
+		backend.mu.Unlock()
+
+		select {
+		case <-time.After(backend.delay):
+		case <-r.Context().Done():
+			return
+		}
+		response, ok := backend.responses[r.URL.Path]
+		if !ok {
+			http.Error(w, `{"error":"not found"}`, http.StatusNotFound)
+			return
+		}
+		if backend.status != 0 {
+			w.WriteHeader(backend.status)
+		}
+		for _, line := range strings.SplitAfter(response, "\n") {
+			w.Write([]byte(line))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+// requestsTo returns the requests the backend received for a path.
+func (b *fakeBackend) requestsTo(path string) []fakeRequest {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var requests []fakeRequest
+	for _, request := range b.requests {
+		if request.Path == path {
+			requests = append(requests, request)
+		}
+	}
+	return requests
+}
+
+// ollamaChat is an answer of /api/chat streaming the given tokens as NDJSON, followed by the last chunk.
+func ollamaChat(tokens ...string) string {
+	var sb strings.Builder
+	encoder := json.NewEncoder(&sb)
+	for _, token := range tokens {
+		encoder.Encode(map[string]any{"message": map[string]string{"role": "assistant", "content": token}, "done": false})
+	}
+	encoder.Encode(map[string]any{"message": map[string]string{"role": "assistant", "content": ""}, "done": true})
+	return sb.String()
+}
+
+type serverSentEvent struct {
+	Event string
+	Data  string
+}
+
+// parseServerSentEvents splits an event stream into its events, joining multiple data fields with newlines.
+func parseServerSentEvents(t *testing.T, stream string) []serverSentEvent {
+	t.Helper()
+	if stream != "" && !strings.HasSuffix(stream, "\n\n") {
+		t.Fatalf("event stream doesn't end with a blank line: %q", stream)
+	}
+
+	var events []serverSentEvent
+	for _, block := range strings.Split(strings.TrimSuffix(stream, "\n\n"), "\n\n") {
+		if block == "" {
+			continue
+		}
+		var event serverSentEvent
+		var data []string
+		for _, line := range strings.Split(block, "\n") {
+			field, value, ok := strings.Cut(line, ": ")
+			if !ok {
+				t.Fatalf("malformed event line %q", line)
+			}
+			switch field {
+			case "event":
+				event.Event = value
+			case "data":
+				data = append(data, value)
+			default:
+				t.Fatalf("unexpected field %q", field)
+			}
+		}
+		event.Data = strings.Join(data, "\n")
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestWriteServerSentEvent(t *testing.T) {
+	tests := []struct {
+		name  string
+		event string
+		data  string
+		want  string
+	}{
+		{name: "single line", event: "token", data: "Hello", want: "event: token\ndata: Hello\n\n"},
+		{name: "multi-line data", event: "token", data: "one\ntwo\n", want: "event: token\ndata: one\ndata: two\ndata: \n\n"},
+		{name: "empty data", event: "done", data: "", want: "event: done\ndata: \n\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			if err := writeServerSentEvent(recorder, test.event, test.data); err != nil {
+				t.Fatal(err)
+			}
+			if got := recorder.Body.String(); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+
+			events := parseServerSentEvents(t, recorder.Body.String())
+			if len(events) != 1 || events[0].Event != test.event || events[0].Data != test.data {
+				t.Errorf("parsed %+v, want the original event", events)
+			}
+		})
+	}
+}
+
+// streamAnswer registers a question of a conversation, or of a new one for id 0, and connects to its event stream.
+func streamAnswer(t *testing.T, server *Server, conversationID int64, question string) []serverSentEvent {
+	t.Helper()
+	stream, err := server.streamService.Create(question, false, services.RetrievalOptions{}, conversationID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/chat/stream/"+stream.ID, nil)
+	request.SetPathValue("id", stream.ID)
+	recorder := httptest.NewRecorder()
+	server.streamAiResponse(recorder, request)
+
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("Content-Type = %q, want text/event-stream", contentType)
+	}
+	return parseServerSentEvents(t, recorder.Body.String())
+}
+
+// createConversation creates a conversation without messages.
+func createConversation(t *testing.T, server *Server) int64 {
+	t.Helper()
+	conversation, err := server.vectorDB.StartConversation("Test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conversation.ID
+}
+
+func TestStreamAiResponse(t *testing.T) {
+	for _, newConversation := range []bool{false, true} {
+		ollama := newFakeBackend(t, map[string]string{"/api/chat": ollamaChat("Hello", ", <b>world</b>", "\nSecond line")})
+		server := newTestServer(t, ollama.URL)
+		var conversationID int64
+		if !newConversation {
+			conversationID = createConversation(t, server)
+		}
+
+		events := streamAnswer(t, server, conversationID, "Hi?")
+
+		for _, request := range ollama.requestsTo("/api/chat") {
+			var chat services.ChatRequest
+			if err := json.Unmarshal([]byte(request.Body), &chat); err != nil || !chat.Stream {
+				t.Errorf("expected a streamed chat request, got %s", request.Body)
+			}
+		}
+
+		conversations, err := server.vectorDB.ListConversations()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(conversations) != 1 {
+			t.Fatalf("new conversation %v: %d conversations, want 1", newConversation, len(conversations))
+		}
+		if newConversation && conversations[0].Title != "Hi?" {
+			t.Errorf("new conversation titled %q, want the question", conversations[0].Title)
+		}
+
+		want := []serverSentEvent{
+			{Event: "token", Data: "Hello"},
+			{Event: "token", Data: ", &lt;b&gt;world&lt;/b&gt;"},
+			{Event: "token", Data: "\nSecond line"},
+			{Event: "conversation"},
+			{Event: "done", Data: ""},
+		}
+		if len(events) == len(want) {
+			// The page learns the id of the conversation, which is new if it didn't have one
+			wantID := fmt.Sprintf(`id="conversation-id" value="%d"`, conversations[0].ID)
+			if !strings.Contains(events[3].Data, wantID) {
+				t.Errorf("conversation event = %q, want it to contain %q", events[3].Data, wantID)
+			}
+			events[3].Data = ""
+		}
+		if !reflect.DeepEqual(events, want) {
+			t.Fatalf("new conversation %v: events = %+v, want %+v", newConversation, events, want)
+		}
+
+		messages, err := server.vectorDB.GetConversationMessages(conversations[0].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantMessages := []services.ChatMessage{
+			{Role: "user", Content: "Hi?"},
+			{Role: "assistant", Content: "Hello, <b>world</b>\nSecond line"},
+		}
+		if !reflect.DeepEqual(messages, wantMessages) {
+			t.Errorf("new conversation %v: stored messages = %+v, want %+v", newConversation, messages, wantMessages)
+		}
+	}
+}
+
+func TestStreamAiResponseError(t *testing.T) {
+	chunk := `{"message":{"role":"assistant","content":"Hel"},"done":false}` + "\n"
+	tests := []struct {
+		name            string
+		status          int
+		response        string
+		newConversation bool
+		wantErr         string
+	}{
+		{name: "HTTP error", status: http.StatusNotFound, response: `{"error":"model "test-llm" not found"}`,
+			wantErr: "HTTP error 404: {&#34;error&#34;:&#34;model &#34;test-llm&#34; not found&#34;}"},
+		{name: "error chunk", response: chunk + `{"error":"model runner crashed"}` + "\n",
+			wantErr: "model runner crashed"},
+		{name: "stream ending before the last chunk", response: chunk + chunk,
+			wantErr: "ended before the last chunk"},
+		{name: "error in a new conversation", status: http.StatusNotFound, response: `{"error":"model "test-llm" not found"}`,
+			newConversation: true, wantErr: "HTTP error 404"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ollama := newFakeBackend(t, map[string]string{"/api/chat": test.response})
+			ollama.status = test.status
+			server := newTestServer(t, ollama.URL)
+			var conversationID int64
+			if !test.newConversation {
+				conversationID = createConversation(t, server)
+			}
+
+			events := streamAnswer(t, server, conversationID, "Hi?")
+
+			if len(events) < 2 || events[len(events)-2].Event != "error" || events[len(events)-1].Event != "done" {
+				t.Fatalf("events = %+v, want an error and a done event last", events)
+			}
+			if errorEvent := events[len(events)-2]; !strings.Contains(errorEvent.Data, test.wantErr) {
+				t.Errorf("error event = %q, want it to contain %q", errorEvent.Data, test.wantErr)
+			}
+			assertNoMessages(t, server, conversationID)
+		})
+	}
+}
+
+// assertNoMessages checks that a failed answer didn't leave its question in the conversation, or, for a new
+// conversation (id 0), that it didn't leave an empty conversation behind.
+func assertNoMessages(t *testing.T, server *Server, conversationID int64) {
+	t.Helper()
+	if conversationID == 0 {
+		conversations, err := server.vectorDB.ListConversations()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(conversations) != 0 {
+			t.Errorf("conversations = %+v, want none", conversations)
+		}
+		return
+	}
+
+	messages, err := server.vectorDB.GetConversationMessages(conversationID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 0 {
+		t.Errorf("stored messages = %+v, want none", messages)
+	}
+}
+
+func TestFetchAiResponseError(t *testing.T) {
+	for _, newConversation := range []bool{false, true} {
+		server := newTestServer(t, newFakeBackend(t, nil).URL)
+		form := url.Values{"message": {"Hi?"}}
+		var conversationID int64
+		if !newConversation {
+			conversationID = createConversation(t, server)
+			form.Set("conversation_id", strconv.FormatInt(conversationID, 10))
+		}
+
+		request := httptest.NewRequest(http.MethodPost, "/chat", strings.NewReader(form.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		recorder := httptest.NewRecorder()
+		server.fetchAiResponse(recorder, request)
+
+		if recorder.Code != http.StatusInternalServerError {
+			t.Errorf("new conversation %v: status = %d, want 500", newConversation, recorder.Code)
+		}
+		assertNoMessages(t, server, conversationID)
+	}
+}
+
+func TestStreamAiResponseUnknownStream(t *testing.T) {
+	server := newTestServer(t, "http://127.0.0.1:0")
+
+	request := httptest.NewRequest(http.MethodGet, "/chat/stream/unknown", nil)
+	request.SetPathValue("id", "unknown")
+	recorder := httptest.NewRecorder()
+	server.streamAiResponse(recorder, request)
+
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", recorder.Code)
+	}
+}
+
+func TestListModelsAPIKey(t *testing.T) {
+	tests := []struct {
+		name           string
+		form           url.Values
+		stored         string
+		storedProvider services.ProviderKind // ProviderOpenAI if empty
+		storedURL      string                // The URL of the backend if empty
+		want           string
+	}{
+		{name: "entered key", form: url.Values{"api_key": {" typed-key "}}, stored: "stored-key", want: "Bearer typed-key"},
+		{name: "empty field keeps the stored key", form: url.Values{"api_key": {""}}, stored: "stored-key", want: "Bearer stored-key"},
+		{name: "stored key not sent to a new URL", form: url.Values{"api_key": {""}}, stored: "stored-key", storedURL: "http://127.0.0.1:0", want: ""},
+		{name: "stored key not sent to a new provider", form: url.Values{"api_key": {""}}, stored: "stored-key",
+			storedProvider: services.ProviderOllama, want: ""},
+		{name: "entered key sent to a new URL", form: url.Values{"api_key": {"typed-key"}}, stored: "stored-key", storedURL: "http://127.0.0.1:0",
+			want: "Bearer typed-key"},
+		{name: "removed key", form: url.Values{"api_key": {""}, "clear_api_key": {"on"}}, stored: "stored-key", want: ""},
+		{name: "no key", form: url.Values{"api_key": {""}}, want: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := newFakeBackend(t, map[string]string{"/v1/models": `{"data":[{"id":"test-llm"}]}`})
+			server := newTestServer(t, backend.URL)
+
+			settings, err := server.vectorDB.GetSettings()
+			if err != nil {
+				t.Fatal(err)
+			}
+			settings.Provider, settings.URL, settings.APIKey = services.ProviderOpenAI, backend.URL, test.stored
+			if test.storedProvider != "" {
+				settings.Provider = test.storedProvider
+			}
+			if test.storedURL != "" {
+				settings.URL = test.storedURL
+			}
+			if err := server.vectorDB.UpdateSettings(*settings); err != nil {
+				t.Fatal(err)
+			}
+
+			test.form.Set("provider", string(services.ProviderOpenAI))
+			test.form.Set("url", backend.URL)
+			request := httptest.NewRequest(http.MethodPost, "/settings/models", strings.NewReader(test.form.Encode()))
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			recorder := httptest.NewRecorder()
+			server.ListModels(recorder, request)
+
+			var authorizations []string
+			for _, request := range backend.requestsTo("/v1/models") {
+				authorizations = append(authorizations, request.Authorization)
+			}
+			if !reflect.DeepEqual(authorizations, []string{test.want}) {
+				t.Errorf("Authorization headers = %q, want %q", authorizations, test.want)
+			}
+			if body := recorder.Body.String(); !strings.Contains(body, "test-llm") {
+				t.Errorf("model picker doesn't list the model: %s", body)
+			}
+		})
+	}
+}
+
+func TestSettingsFormHidesAPIKey(t *testing.T) {
+	server := newTestServer(t, "http://127.0.0.1:0")
+
+	for _, apiKey := range []string{"", "secret-key"} {
+		data := struct {
+			services.Settings
+			Reembed    reembedProgress
+			CacheStats services.EmbeddingCacheStats
+		}{
+			Settings: services.Settings{Provider: services.ProviderOpenAI, APIKey: apiKey},
+		}
+		var sb strings.Builder
+		if err := server.templates.ExecuteTemplate(&sb, "settings-form.html", data); err != nil {
+			t.Fatal(err)
+		}
+
+		form := sb.String()
+		if apiKey != "" && strings.Contains(form, apiKey) {
+			t.Errorf("settings form contains the API key: %s", form)
+		}
+		if hasClear := strings.Contains(form, `name="clear_api_key"`); hasClear != (apiKey != "") {
+			t.Errorf("settings form offers to remove the key: %v, want %v", hasClear, apiKey != "")
+		}
+	}
+}
@@ -0,0 +1,447 @@
+package services
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ChunkStrategy names a way of splitting a document into chunks.
+type ChunkStrategy string
+
+const (
+	// ChunkSentences groups sentences; size and overlap count sentences.
+	ChunkSentences ChunkStrategy = "sentence"
+	// ChunkTokens slides a fixed window over the tokens (whitespace separated words) of the text.
+	ChunkTokens ChunkStrategy = "tokens"
+	// ChunkMarkdown splits at Markdown headings and prefixes every chunk with its headings; size and overlap count characters.
+	ChunkMarkdown ChunkStrategy = "markdown"
+	// ChunkRecursive splits at paragraphs, then lines, sentences and words until chunks fit; size and overlap count characters.
+	ChunkRecursive ChunkStrategy = "recursive"
+)
+
+// ChunkOptions configure how a document is split into chunks.
+type ChunkOptions struct {
+	Strategy ChunkStrategy
+	Size     int
+	Overlap  int
+}
+
+// DefaultChunkOptions returns the default size and overlap of a chunking strategy.
+func DefaultChunkOptions(strategy ChunkStrategy) ChunkOptions {
+	switch strategy {
+	case ChunkTokens:
+		return ChunkOptions{Strategy: strategy, Size: 256, Overlap: 32}
+	case ChunkMarkdown, ChunkRecursive:
+		return ChunkOptions{Strategy: strategy, Size: 1500, Overlap: 200}
+	default:
+		return ChunkOptions{Strategy: ChunkSentences, Size: 16, Overlap: 4}
+	}
+}
+
+// minChunkSize is the smallest chunk size of a strategy. Chunks of fewer characters than a short sentence
+// carry no meaning of their own, and Markdown chunks need room for their headings.
+func minChunkSize(strategy ChunkStrategy) int {
+	switch strategy {
+	case ChunkMarkdown, ChunkRecursive:
+		return 50
+	default:
+		return 1
+	}
+}
+
+// Chunker splits a text into chunks to be embedded.
+type Chunker interface {
+	Chunk(text string) []string
+}
+
+// NewChunker returns the chunker of the strategy in the options.
+func NewChunker(options ChunkOptions) (Chunker, error) {
+	if minSize := minChunkSize(options.Strategy); options.Size < minSize {
+		return nil, fmt.Errorf("chunk size must be at least %d", minSize)
+	}
+	if options.Overlap < 0 {
+		return nil, fmt.Errorf("chunk overlap must be non-negative")
+	}
+	if options.Overlap >= options.Size {
+		return nil, fmt.Errorf("chunk overlap must be less than chunk size")
+	}
+
+	switch options.Strategy {
+	case ChunkSentences:
+		return sentenceChunker{size: options.Size, overlap: options.Overlap}, nil
+	case ChunkTokens:
+		return tokenChunker{size: options.Size, overlap: options.Overlap}, nil
+	case ChunkMarkdown:
+		return markdownChunker{size: options.Size, overlap: options.Overlap}, nil
+	case ChunkRecursive:
+		return newRecursiveChunker(options.Size, options.Overlap), nil
+	default:
+		return nil, fmt.Errorf("unknown chunking strategy %q", options.Strategy)
+	}
+}
+
+// chunkWindows returns the [start, end) ranges of windows of the given size over n items, where consecutive
+// windows share overlap items. The last window ends at n. Windows move on by at least one item, even if the
+// overlap isn't less than the size, so a bad size can't loop forever.
+func chunkWindows(n int, size int, overlap int) [][2]int {
+	size = max(size, 1)
+	step := max(size-overlap, 1)
+
+	var windows [][2]int
+	for start := 0; start < n; start += step {
+		end := min(start+size, n)
+		windows = append(windows, [2]int{start, end})
+		if end == n {
+			break
+		}
+	}
+	return windows
+}
+
+type sentenceChunker struct {
+	size    int
+	overlap int
+}
+
+func (c sentenceChunker) Chunk(text string) []string {
+	sentences := splitIntoSentences(text)
+
+	var chunks []string
+	for _, window := range chunkWindows(len(sentences), c.size, c.overlap) {
+		var sb strings.Builder
+		for i, sentence := range sentences[window[0]:window[1]] {
+			if i > 0 {
+				sb.WriteString(sentence.separator)
+			}
+			sb.WriteString(sentence.text)
+		}
+		chunks = append(chunks, sb.String())
+	}
+	return chunks
+}
+
+// sentence is a unit of the sentence chunker. The separator joins it to the previous sentence of a chunk:
+// a space within a paragraph, a line break between list items and a blank line between paragraphs.
+type sentence struct {
+	text      string
+	separator string
+}
+
+var (
+	fencedCodeRegex  = regexp.MustCompile("^\\s*(```|~~~)")
+	headingRegex     = regexp.MustCompile(`^(#{1,6})\s+(.*)$`)
+	listItemRegex    = regexp.MustCompile(`^\s*([-*+]|\d+[.)])\s+`)
+	tableRowRegex    = regexp.MustCompile(`^\s*\|`)
+	sentenceEndRegex = regexp.MustCompile(`[.!?]+["'”’)\]]*\s+`)
+)
+
+// splitIntoSentences splits a text into sentences. Paragraphs, Markdown headings, list items and table rows
+// always start a new sentence, fenced code blocks are kept whole, and abbreviations, initials and decimal
+// numbers do not end a sentence.
+func splitIntoSentences(text string) []sentence {
+	var (
+		sentences []sentence
+		paragraph []string
+		separator = "\n\n"
+		code      []string
+		fence     string
+	)
+
+	flushParagraph := func() {
+		for i, text := range splitProse(strings.Join(paragraph, " ")) {
+			if i == 0 {
+				sentences = append(sentences, sentence{text: text, separator: separator})
+			} else {
+				sentences = append(sentences, sentence{text: text, separator: " "})
+			}
+		}
+		paragraph = nil
+		separator = "\n\n"
+	}
+
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		if fence != "" {
+			code = append(code, line)
+			if strings.HasPrefix(strings.TrimSpace(line), fence) {
+				sentences = append(sentences, sentence{text: strings.Join(code, "\n"), separator: "\n\n"})
+				code, fence = nil, ""
+			}
+			continue
+		}
+
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case fencedCodeRegex.MatchString(line):
+			flushParagraph()
+			fence = fencedCodeRegex.FindStringSubmatch(line)[1]
+			code = []string{line}
+		case trimmed == "":
+			flushParagraph()
+		case headingRegex.MatchString(trimmed):
+			flushParagraph()
+			sentences = append(sentences, sentence{text: trimmed, separator: "\n\n"})
+		case listItemRegex.MatchString(line) || tableRowRegex.MatchString(line):
+			continuesBlock := len(paragraph) > 0
+			flushParagraph()
+			if continuesBlock {
+				separator = "\n"
+			}
+			paragraph = []string{trimmed}
+		default:
+			paragraph = append(paragraph, trimmed)
+		}
+	}
+	flushParagraph()
+	if len(code) > 0 { // Unterminated code block
+		sentences = append(sentences, sentence{text: strings.Join(code, "\n"), separator: "\n\n"})
+	}
+
+	return sentences
+}
+
+// sentenceAbbreviations end with a period, but rarely end a sentence.
+var sentenceAbbreviations = map[string]bool{
+	"mr": true, "mrs": true, "ms": true, "dr": true, "prof": true, "sr": true, "jr": true, "st": true,
+	"vs": true, "etc": true, "cf": true, "fig": true, "no": true, "nr": true, "approx": true, "ca": true,
+	"inc": true, "ltd": true, "co": true, "corp": true, "dept": true, "est": true, "vol": true, "p": true,
+	"bzw": true, "usw": true, "ggf": true, "vgl": true, "z": true, "evtl": true,
+}
+
+// splitProse splits a paragraph of prose at sentence-ending punctuation followed by whitespace.
+func splitProse(paragraph string) []string {
+	var sentences []string
+	start := 0
+	for _, match := range sentenceEndRegex.FindAllStringIndex(paragraph, -1) {
+		punctuation := strings.TrimRightFunc(paragraph[match[0]:match[1]], unicode.IsSpace)
+		if punctuation == "." && isAbbreviation(paragraph[start:match[0]]) {
+			continue
+		}
+		// A new sentence does not start in lower case
+		if next, _ := utf8.DecodeRuneInString(paragraph[match[1]:]); unicode.IsLower(next) {
+			continue
+		}
+
+		if text := strings.TrimSpace(paragraph[start:match[1]]); text != "" {
+			sentences = append(sentences, text)
+		}
+		start = match[1]
+	}
+	if text := strings.TrimSpace(paragraph[start:]); text != "" {
+		sentences = append(sentences, text)
+	}
+	return sentences
+}
+
+// isAbbreviation reports whether the last word of a text is an abbreviation, an initial or contains periods
+// itself (e.g. "U.S", but not a decimal number like "2.5"), so a period after it does not end the sentence.
+// A number on its own is the marker of a numbered list item.
+func isAbbreviation(text string) bool {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return false
+	}
+	word := strings.TrimLeft(fields[len(fields)-1], `("'[`)
+	if word == "" {
+		return false
+	}
+	if utf8.RuneCountInString(word) == 1 && unicode.IsUpper([]rune(word)[0]) {
+		return true
+	}
+	if len(fields) == 1 && strings.IndexFunc(word, func(r rune) bool { return !unicode.IsDigit(r) }) < 0 {
+		return true
+	}
+	if i := strings.LastIndex(word, "."); i >= 0 {
+		return strings.IndexFunc(word[i+1:], unicode.IsLetter) >= 0
+	}
+	return sentenceAbbreviations[strings.ToLower(word)]
+}
+
+type tokenChunker struct {
+	size    int
+	overlap int
+}
+
+var tokenRegex = regexp.MustCompile(`\S+`)
+
+// Chunk cuts the text at token boundaries, so the chunks keep the original whitespace and line breaks.
+func (c tokenChunker) Chunk(text string) []string {
+	tokens := tokenRegex.FindAllStringIndex(text, -1)
+
+	var chunks []string
+	for _, window := range chunkWindows(len(tokens), c.size, c.overlap) {
+		chunks = append(chunks, text[tokens[window[0]][0]:tokens[window[1]-1][1]])
+	}
+	return chunks
+}
+
+// recursiveChunker splits a text at the first of its separators that occurs in it and merges the pieces into
+// chunks of at most size characters. Pieces that are still too long are split with the next separator.
+type recursiveChunker struct {
+	size       int
+	overlap    int
+	separators []string
+}
+
+func newRecursiveChunker(size int, overlap int) recursiveChunker {
+	return recursiveChunker{size: size, overlap: overlap, separators: []string{"\n\n", "\n", ". ", " ", ""}}
+}
+
+func (c recursiveChunker) Chunk(text string) []string {
+	return c.split(strings.TrimSpace(text), c.separators)
+}
+
+func (c recursiveChunker) split(text string, separators []string) []string {
+	if text == "" {
+		return nil
+	}
+	if utf8.RuneCountInString(text) <= c.size {
+		return []string{text}
+	}
+
+	separator, remaining := "", []string(nil)
+	for i, candidate := range separators {
+		if candidate == "" || strings.Contains(text, candidate) {
+			separator, remaining = candidate, separators[i+1:]
+			break
+		}
+	}
+	if separator == "" {
+		// Nothing left to split at, so cut the text into windows of characters
+		runes := []rune(text)
+		var chunks []string
+		for _, window := range chunkWindows(len(runes), c.size, c.overlap) {
+			if chunk := strings.TrimSpace(string(runes[window[0]:window[1]])); chunk != "" {
+				chunks = append(chunks, chunk)
+			}
+		}
+		return chunks
+	}
+
+	var (
+		chunks        []string
+		current       []string
+		currentLength int
+	)
+	flush := func() {
+		if chunk := strings.TrimSpace(strings.Join(current, "")); chunk != "" {
+			chunks = append(chunks, chunk)
+		}
+	}
+
+	// SplitAfter keeps the separators, so joining the pieces restores the original text
+	for _, piece := range strings.SplitAfter(text, separator) {
+		pieceLength := utf8.RuneCountInString(piece)
+		if pieceLength > c.size {
+			flush()
+			current, currentLength = nil, 0
+			chunks = append(chunks, c.split(piece, remaining)...)
+			continue
+		}
+
+		if currentLength+pieceLength > c.size && len(current) > 0 {
+			flush()
+			// Keep the trailing pieces that fit into the overlap and leave room for the new piece
+			for len(current) > 0 && (currentLength > c.overlap || currentLength+pieceLength > c.size) {
+				currentLength -= utf8.RuneCountInString(current[0])
+				current = current[1:]
+			}
+		}
+		current = append(current, piece)
+		currentLength += pieceLength
+	}
+	flush()
+
+	return chunks
+}
+
+type markdownChunker struct {
+	size    int
+	overlap int
+}
+
+// markdownSection is the text below a heading, up to the next heading.
+type markdownSection struct {
+	headings []string // Headings leading to the section, from the top level down
+	body     string
+}
+
+// Chunk splits the text into its sections and prefixes every chunk with the headings of its section,
+// so a chunk can be understood without the rest of the document. Long sections are split recursively.
+func (c markdownChunker) Chunk(text string) []string {
+	var chunks []string
+	for _, section := range splitMarkdownSections(text) {
+		prefix := strings.Join(section.headings, "\n")
+
+		size := c.size - utf8.RuneCountInString(prefix) - 1
+		if size < c.size/2 { // Very long headings still leave room for content
+			size = c.size / 2
+		}
+		size = max(size, 1)
+		body := newRecursiveChunker(size, min(c.overlap, size/2))
+
+		for _, part := range body.Chunk(section.body) {
+			if prefix != "" {
+				part = prefix + "\n" + part
+			}
+			chunks = append(chunks, part)
+		}
+	}
+	return chunks
+}
+
+// splitMarkdownSections splits a Markdown text at its ATX headings ("# Title"), ignoring lines in code blocks.
+func splitMarkdownSections(text string) []markdownSection {
+	var (
+		sections []markdownSection
+		headings []string
+		levels   []int
+		body     []string
+		fence    string
+	)
+
+	flush := func() {
+		if strings.TrimSpace(strings.Join(body, "\n")) != "" {
+			sections = append(sections, markdownSection{
+				headings: append([]string(nil), headings...),
+				body:     strings.Join(body, "\n"),
+			})
+		}
+		body = nil
+	}
+
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		if fence != "" {
+			if strings.HasPrefix(strings.TrimSpace(line), fence) {
+				fence = ""
+			}
+			body = append(body, line)
+			continue
+		}
+		if match := fencedCodeRegex.FindStringSubmatch(line); match != nil {
+			fence = match[1]
+			body = append(body, line)
+			continue
+		}
+
+		match := headingRegex.FindStringSubmatch(strings.TrimRight(line, " \t"))
+		if match == nil {
+			body = append(body, line)
+			continue
+		}
+
+		flush()
+		level := len(match[1])
+		for len(levels) > 0 && levels[len(levels)-1] >= level {
+			levels = levels[:len(levels)-1]
+			headings = headings[:len(headings)-1]
+		}
+		levels = append(levels, level)
+		headings = append(headings, strings.TrimSpace(line))
+	}
+	flush()
+
+	return sections
+}
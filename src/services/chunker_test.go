@@ -0,0 +1,226 @@
+package services
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitIntoSentences(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []string
+	}{
+		{
+			name: "abbreviations",
+			text: "Dr. Smith met Mr. Jones at 5 p.m. today. They talked about etc. and more. See e.g. the U.S. edition.",
+			want: []string{"Dr. Smith met Mr. Jones at 5 p.m. today.", "They talked about etc. and more.", "See e.g. the U.S. edition."},
+		},
+		{
+			name: "initials",
+			text: "J. R. R. Tolkien wrote books. He was born in 1892. Done!",
+			want: []string{"J. R. R. Tolkien wrote books.", "He was born in 1892.", "Done!"},
+		},
+		{
+			name: "decimals",
+			text: "Pi is about 3.14 and e is 2.72. Both are irrational.",
+			want: []string{"Pi is about 3.14 and e is 2.72.", "Both are irrational."},
+		},
+		{
+			name: "fenced code",
+			text: "Run this:\n\n```\nfoo. Bar.\n\nBaz.\n```\nDone. Really.",
+			want: []string{"Run this:", "```\nfoo. Bar.\n\nBaz.\n```", "Done.", "Really."},
+		},
+		{
+			name: "unterminated fenced code",
+			text: "Intro.\n~~~\ncode. More code.",
+			want: []string{"Intro.", "~~~\ncode. More code."},
+		},
+		{
+			name: "markdown headings",
+			text: "# Title\nSome text. More text.\n## Sub\nEnd.",
+			want: []string{"# Title", "Some text.", "More text.", "## Sub", "End."},
+		},
+		{
+			name: "list items",
+			text: "Steps:\n- First. Still first.\n- Second\n1. Third\n2) Fourth",
+			want: []string{"Steps:", "- First.", "Still first.", "- Second", "1. Third", "2) Fourth"},
+		},
+		{
+			name: "lower case continues the sentence",
+			text: "It costs approx. ten euros. that is cheap. Really.",
+			want: []string{"It costs approx. ten euros. that is cheap.", "Really."},
+		},
+		{
+			name: "empty",
+			text: " \n\n ",
+			want: nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []string
+			for _, sentence := range splitIntoSentences(test.text) {
+				got = append(got, sentence.text)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("sentences = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestChunk(t *testing.T) {
+	tests := []struct {
+		name    string
+		options ChunkOptions
+		text    string
+		want    []string
+	}{
+		{
+			name:    "sentences joined with their separators",
+			options: ChunkOptions{Strategy: ChunkSentences, Size: 2},
+			text:    "Intro. Text.\n\n- One\n- Two",
+			want:    []string{"Intro. Text.", "- One\n- Two"},
+		},
+		{
+			name:    "sentence overlap",
+			options: ChunkOptions{Strategy: ChunkSentences, Size: 2, Overlap: 1},
+			text:    "One. Two. Three.",
+			want:    []string{"One. Two.", "Two. Three."},
+		},
+		{
+			name:    "token window keeps whitespace",
+			options: ChunkOptions{Strategy: ChunkTokens, Size: 3, Overlap: 1},
+			text:    "a b\nc d  e",
+			want:    []string{"a b\nc", "c d  e"},
+		},
+		{
+			name:    "single token",
+			options: ChunkOptions{Strategy: ChunkTokens, Size: 1},
+			text:    "a b",
+			want:    []string{"a", "b"},
+		},
+		{
+			name:    "recursive keeps short text whole",
+			options: ChunkOptions{Strategy: ChunkRecursive, Size: 50},
+			text:    "  Short text.  ",
+			want:    []string{"Short text."},
+		},
+		{
+			name:    "recursive splits paragraphs, then sentences",
+			options: ChunkOptions{Strategy: ChunkRecursive, Size: 50},
+			text:    "The first sentence is here. The second one follows. A third one ends it.\n\nAnother paragraph.",
+			want:    []string{"The first sentence is here.", "The second one follows. A third one ends it.", "Another paragraph."},
+		},
+		{
+			name:    "recursive overlap",
+			options: ChunkOptions{Strategy: ChunkRecursive, Size: 50, Overlap: 20},
+			text:    "w01 w02 w03 w04 w05 w06 w07 w08 w09 w10 w11 w12 w13 w14 w15 w16 w17 w18 w19 w20",
+			want: []string{
+				"w01 w02 w03 w04 w05 w06 w07 w08 w09 w10 w11 w12",
+				"w08 w09 w10 w11 w12 w13 w14 w15 w16 w17 w18 w19",
+				"w15 w16 w17 w18 w19 w20",
+			},
+		},
+		{
+			name:    "markdown headings prefix their sections",
+			options: ChunkOptions{Strategy: ChunkMarkdown, Size: 50, Overlap: 10},
+			text:    "# A\n\nText one.\n\n## B\n\nText two.\n\n```\n# not a heading\n```\n# C\nThird.",
+			want:    []string{"# A\nText one.", "# A\n## B\nText two.\n\n```\n# not a heading\n```", "# C\nThird."},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chunker, err := NewChunker(test.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := chunker.Chunk(test.text); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("chunks = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNewChunker(t *testing.T) {
+	tests := []struct {
+		name    string
+		options ChunkOptions
+		wantErr string
+	}{
+		{name: "one sentence", options: ChunkOptions{Strategy: ChunkSentences, Size: 1}},
+		{name: "one token", options: ChunkOptions{Strategy: ChunkTokens, Size: 1}},
+		{name: "smallest recursive", options: ChunkOptions{Strategy: ChunkRecursive, Size: 50}},
+		{name: "no sentences", options: ChunkOptions{Strategy: ChunkSentences, Size: 0}, wantErr: "at least 1"},
+		{name: "tiny markdown", options: ChunkOptions{Strategy: ChunkMarkdown, Size: 1}, wantErr: "at least 50"},
+		{name: "tiny recursive", options: ChunkOptions{Strategy: ChunkRecursive, Size: 49}, wantErr: "at least 50"},
+		{name: "negative overlap", options: ChunkOptions{Strategy: ChunkTokens, Size: 4, Overlap: -1}, wantErr: "non-negative"},
+		{name: "overlap as large as the size", options: ChunkOptions{Strategy: ChunkTokens, Size: 4, Overlap: 4}, wantErr: "less than"},
+		{name: "unknown strategy", options: ChunkOptions{Strategy: "words", Size: 4}, wantErr: "unknown"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewChunker(test.options)
+			if test.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Fatalf("error = %v, want it to contain %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+// TestVerySmallSizes checks that the chunkers end even with sizes NewChunker refuses.
+func TestVerySmallSizes(t *testing.T) {
+	tests := []struct {
+		name    string
+		chunker Chunker
+		text    string
+		want    []string
+	}{
+		{name: "markdown", chunker: markdownChunker{size: 1}, text: "# A\n\nab", want: []string{"# A\na", "# A\nb"}},
+		{name: "recursive", chunker: newRecursiveChunker(1, 0), text: "ab c", want: []string{"a", "b", "c"}},
+		{name: "recursive overlap as large as the size", chunker: newRecursiveChunker(1, 1), text: "ab", want: []string{"a", "b"}},
+		{name: "tokens without size", chunker: tokenChunker{size: 0}, text: "a b", want: []string{"a", "b"}},
+		{name: "sentences with overlap beyond the size", chunker: sentenceChunker{size: 1, overlap: 2}, text: "One. Two.", want: []string{"One.", "Two."}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.chunker.Chunk(test.text); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("chunks = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestChunkWindows(t *testing.T) {
+	tests := []struct {
+		name    string
+		n       int
+		size    int
+		overlap int
+		want    [][2]int
+	}{
+		{name: "no items", n: 0, size: 2, overlap: 0, want: nil},
+		{name: "one window", n: 2, size: 4, overlap: 1, want: [][2]int{{0, 2}}},
+		{name: "overlap", n: 5, size: 3, overlap: 1, want: [][2]int{{0, 3}, {2, 5}}},
+		{name: "last window ends at n", n: 4, size: 3, overlap: 0, want: [][2]int{{0, 3}, {3, 4}}},
+		{name: "overlap as large as the size", n: 3, size: 2, overlap: 2, want: [][2]int{{0, 2}, {1, 3}}},
+		{name: "zero size", n: 2, size: 0, overlap: 0, want: [][2]int{{0, 1}, {1, 2}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := chunkWindows(test.n, test.size, test.overlap); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("windows = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
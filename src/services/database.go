@@ -6,9 +6,9 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 
 	_ "github.com/tursodatabase/go-libsql"
 )
@@ -16,17 +16,92 @@ import (
 // VectorService represents the service responsible for the vector database.
 type VectorService struct {
 	db *sql.DB
+
+	// vectorsMu serializes the transactions storing embeddings or rebuilding the vectors table, see
+	// ensureEmbeddingCompatible. SQLite would otherwise fail the second writer with "database is locked".
+	vectorsMu sync.Mutex
 }
 
 type VectorItem struct {
-	Text      string
-	Embedding []byte
+	ID         int64
+	DocumentID int64
+	Title      string
+	Text       string
+	Embedding  []byte
+	Distance   float64 // Cosine distance to the query, only set by FindSimilarVectors
 }
 
 type Settings struct {
-	URL       string
-	LLM       string
-	Embedding string
+	Provider      ProviderKind // API spoken by the LLM backend at URL
+	URL           string
+	APIKey        string // Only sent to OpenAI-compatible providers
+	LLM           string
+	Embedding     string
+	VisionModel   string        // Model analyzing images, empty if image analysis is not used
+	HistoryTurns  int           // Number of previous question/answer pairs replayed to the LLM
+	HistoryTokens int           // Rough token budget for the replayed conversation history
+	TopK          int           // Maximum number of chunks retrieved as context
+	MaxDistance   float64       // Chunks with a larger cosine distance to the question are not used as context
+	RetrievalMode RetrievalMode // Vector search only, or combined with keyword search
+	EmbedBatch    int           // Texts per embedding request
+	EmbedWorkers  int           // Parallel embedding requests
+	EmbedCache    int           // Maximum number of cached embeddings, 0 disables the cache
+	MaxImageSize  int           // Maximum size of uploaded images in MB
+}
+
+// Retrieval returns the retrieval options configured in the settings.
+func (s Settings) Retrieval() RetrievalOptions {
+	return RetrievalOptions{TopK: s.TopK, MaxDistance: s.MaxDistance, Mode: s.RetrievalMode}
+}
+
+// RetrievalOptions control which chunks SearchChunks and FindSimilarVectors return.
+type RetrievalOptions struct {
+	TopK        int
+	MaxDistance float64
+	Mode        RetrievalMode
+	Strategy    SearchStrategy
+}
+
+// SearchStrategy selects how FindSimilarVectors searches the vectors table.
+type SearchStrategy int
+
+const (
+	// SearchAuto uses the vector index, unless the table is small enough for a full scan to be as fast and exact.
+	SearchAuto SearchStrategy = iota
+	// SearchIndexed uses the approximate DiskANN vector index.
+	SearchIndexed
+	// SearchBruteForce compares the query with every stored embedding.
+	SearchBruteForce
+)
+
+// indexedSearchThreshold is the number of chunks from which SearchAuto uses the vector index.
+const indexedSearchThreshold = 4000
+
+// Validate checks that the options are within sensible bounds. The cosine distance ranges from 0 to 2.
+func (o RetrievalOptions) Validate() error {
+	if o.TopK < 1 || o.TopK > 50 {
+		return fmt.Errorf("top-k must be between 1 and 50")
+	}
+	if o.MaxDistance < 0 || o.MaxDistance > 2 {
+		return fmt.Errorf("maximum distance must be between 0 and 2")
+	}
+	if o.Mode != RetrievalVector && o.Mode != RetrievalHybrid {
+		return fmt.Errorf("unknown retrieval mode %q", o.Mode)
+	}
+	return nil
+}
+
+// EmbeddingInfo describes the embeddings currently stored in the vectors table.
+type EmbeddingInfo struct {
+	Model     string
+	Dimension int
+}
+
+type Conversation struct {
+	ID        int64
+	Title     string
+	CreatedAt string
+	UpdatedAt string
 }
 
 // SetUDatabaseService creates and initializes a new VectorDBService.
@@ -46,15 +121,40 @@ func SetUDatabaseService(dbPath string, overwrite bool) (*VectorService, error)
 	}
 	vectorService.db = db
 
+	if err := vectorService.createSettingsTable(); err != nil {
+		db.Close() // Close the connection if table creation fails
+		return nil, fmt.Errorf("failed to ensure settings table exists: %w", err)
+	}
+
 	// Then call ensureVectorTableExists on the instance
 	if err := vectorService.createVectorTable(); err != nil {
 		db.Close() // Close the connection if table creation fails
 		return nil, fmt.Errorf("failed to ensure vector table exists: %w", err)
 	}
 
-	if err := vectorService.createSettingsTable(); err != nil {
+	if err := vectorService.createDocumentsTable(); err != nil {
 		db.Close() // Close the connection if table creation fails
-		return nil, fmt.Errorf("failed to ensure settings table exists: %w", err)
+		return nil, fmt.Errorf("failed to ensure documents table exists: %w", err)
+	}
+
+	if err := vectorService.createJobsTable(); err != nil {
+		db.Close() // Close the connection if table creation fails
+		return nil, fmt.Errorf("failed to ensure jobs table exists: %w", err)
+	}
+
+	if err := vectorService.createEmbeddingCacheTable(); err != nil {
+		db.Close() // Close the connection if table creation fails
+		return nil, fmt.Errorf("failed to ensure embedding cache table exists: %w", err)
+	}
+
+	if err := vectorService.createConversationTables(); err != nil {
+		db.Close() // Close the connection if table creation fails
+		return nil, fmt.Errorf("failed to ensure conversation tables exist: %w", err)
+	}
+
+	if err := vectorService.createImageAnalysesTable(); err != nil {
+		db.Close() // Close the connection if table creation fails
+		return nil, fmt.Errorf("failed to ensure image analyses table exists: %w", err)
 	}
 
 	return vectorService, nil
@@ -90,16 +190,364 @@ func (s *VectorService) createDb(dbPath string) (*sql.DB, error) {
 	return db, nil
 }
 
+// defaultEmbeddingDimension is the dimension of a fresh vectors table (nomic-embed-text). The table is
+// recreated with the dimension of the first stored embedding, as long as it is still empty.
+const defaultEmbeddingDimension = 768
+
+// vectorColumns are the columns of the vectors table besides the embedding, copied when the table is rebuilt.
+const vectorColumns = "id, document_id, title, text, content_hash"
+
+// vectorTableSchema returns the CREATE TABLE statement of the vectors table for embeddings of the given dimension.
+func vectorTableSchema(table string, dimension int) string {
+	return fmt.Sprintf(`CREATE TABLE %s (
+		id INTEGER PRIMARY KEY,
+		document_id INTEGER REFERENCES documents(id),
+		title TEXT,
+		text TEXT,
+		content_hash TEXT,
+		embedding F32_BLOB(%d)
+	)`, table, dimension)
+}
+
 // EnsureVectorTableExists checks if the vector table exists and creates it if not.
 func (s *VectorService) createVectorTable() error {
-	_, err := s.db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS vectors (id INTEGER PRIMARY KEY, title TEXT, text TEXT, embedding F32_BLOB(%d))", 768))
+	var tableCount int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name='vectors'").Scan(&tableCount)
 	if err != nil {
 		return err
 	}
+	if tableCount == 0 {
+		if _, err := s.db.Exec(vectorTableSchema("vectors", defaultEmbeddingDimension)); err != nil {
+			return err
+		}
+	}
+	if err := s.addColumnIfMissing("vectors", "document_id", "INTEGER REFERENCES documents(id)"); err != nil {
+		return err
+	}
+	if err := s.addColumnIfMissing("vectors", "content_hash", "TEXT"); err != nil {
+		return err
+	}
+	if err := s.backfillChunkHashes(); err != nil {
+		return err
+	}
+	if err := createVectorIndexes(s.db); err != nil {
+		return err
+	}
+	if err := s.createFullTextTable(); err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`CREATE TABLE IF NOT EXISTS embedding_meta (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		model TEXT NOT NULL,
+		dimension INTEGER NOT NULL
+	) STRICT`)
+	if err != nil {
+		return fmt.Errorf("failed to create embedding_meta table: %w", err)
+	}
+
+	// Databases from before embedding_meta existed hold vectors of the configured embedding model
+	info, err := s.GetEmbeddingInfo()
+	if err != nil {
+		return err
+	}
+	count, err := countVectors(s.db)
+	if err != nil {
+		return err
+	}
+	if info == nil && count > 0 {
+		settings, err := s.GetSettings()
+		if err != nil {
+			return err
+		}
+		dimension, err := vectorTableDimension(s.db, "vectors")
+		if err != nil {
+			return err
+		}
+		if err := s.setEmbeddingInfo(s.db, EmbeddingInfo{Model: settings.Embedding, Dimension: dimension}); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
+// createVectorIndexes creates the indexes of the vectors table. They are dropped with the table,
+// so they have to be created again whenever the table is recreated.
+func createVectorIndexes(executor sqlExecutor) error {
+	_, err := executor.Exec("CREATE INDEX IF NOT EXISTS vectors_document_idx ON vectors (document_id)")
+	if err != nil {
+		return fmt.Errorf("failed to create vectors document index: %w", err)
+	}
+	_, err = executor.Exec("CREATE INDEX IF NOT EXISTS vectors_hash_idx ON vectors (content_hash)")
+	if err != nil {
+		return fmt.Errorf("failed to create vectors hash index: %w", err)
+	}
+	_, err = executor.Exec("CREATE INDEX IF NOT EXISTS vectors_embedding_idx ON vectors (libsql_vector_idx(embedding, 'metric=cosine'))")
+	if err != nil {
+		return fmt.Errorf("failed to create vector index: %w", err)
+	}
+	return nil
+}
+
+// GetEmbeddingInfo returns the model and dimension of the stored embeddings, or nil if nothing was stored yet.
+func (s *VectorService) GetEmbeddingInfo() (*EmbeddingInfo, error) {
+	return embeddingInfo(s.db)
+}
+
+func embeddingInfo(querier sqlQuerier) (*EmbeddingInfo, error) {
+	var info EmbeddingInfo
+	err := querier.QueryRow("SELECT model, dimension FROM embedding_meta WHERE id=1").Scan(&info.Model, &info.Dimension)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read embedding info: %w", err)
+	}
+	return &info, nil
+}
+
+// sqlExecutor is implemented by both *sql.DB and *sql.Tx.
+type sqlExecutor interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// sqlQuerier is implemented by both *sql.DB and *sql.Tx.
+type sqlQuerier interface {
+	sqlExecutor
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func (s *VectorService) setEmbeddingInfo(executor sqlExecutor, info EmbeddingInfo) error {
+	_, err := executor.Exec(`INSERT INTO embedding_meta (id, model, dimension) VALUES (1, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET model=excluded.model, dimension=excluded.dimension`, info.Model, info.Dimension)
+	if err != nil {
+		return fmt.Errorf("failed to store embedding info: %w", err)
+	}
+	return nil
+}
+
+// NeedsReembedding reports whether the stored vectors were embedded with a different model than the given one.
+func (s *VectorService) NeedsReembedding(model string) (bool, error) {
+	info, err := s.GetEmbeddingInfo()
+	if err != nil {
+		return false, err
+	}
+	count, err := countVectors(s.db)
+	if err != nil {
+		return false, err
+	}
+	return count > 0 && info != nil && normalizeModelName(info.Model) != normalizeModelName(model), nil
+}
+
+func countVectors(querier sqlQuerier) (int, error) {
+	var count int
+	err := querier.QueryRow("SELECT COUNT(*) FROM vectors").Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count vectors: %w", err)
+	}
+	return count, nil
+}
+
+// vectorTableDimension reads the declared dimension of the embedding column, e.g. 768 for F32_BLOB(768).
+func vectorTableDimension(querier sqlQuerier, table string) (int, error) {
+	var columnType string
+	err := querier.QueryRow("SELECT type FROM pragma_table_info(?) WHERE name='embedding'", table).Scan(&columnType)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read embedding column of %s: %w", table, err)
+	}
+
+	var dimension int
+	if _, err := fmt.Sscanf(strings.ToUpper(columnType), "F32_BLOB(%d)", &dimension); err != nil {
+		return 0, fmt.Errorf("unexpected embedding column type %q", columnType)
+	}
+	return dimension, nil
+}
+
+// ensureEmbeddingCompatible makes sure an embedding of the given model and dimension can be stored next to the
+// existing ones. An empty vectors table is adapted to the new embeddings, otherwise mixing is refused. It runs in
+// the transaction storing the embeddings, which must hold vectorsMu, so the check and the rebuild are atomic.
+func (s *VectorService) ensureEmbeddingCompatible(tx *sql.Tx, model string, dimension int) error {
+	count, err := countVectors(tx)
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		tableDimension, err := vectorTableDimension(tx, "vectors")
+		if err != nil {
+			return err
+		}
+		if tableDimension != dimension {
+			log.Printf("Recreating empty vectors table for %d-dimensional embeddings\n", dimension)
+			if _, err := tx.Exec("DROP TABLE vectors"); err != nil {
+				return fmt.Errorf("failed to drop vectors table: %w", err)
+			}
+			if _, err := tx.Exec("DELETE FROM vectors_fts"); err != nil {
+				return fmt.Errorf("failed to clear full-text index: %w", err)
+			}
+			if _, err := tx.Exec(vectorTableSchema("vectors", dimension)); err != nil {
+				return fmt.Errorf("failed to recreate vectors table: %w", err)
+			}
+			if err := createVectorIndexes(tx); err != nil {
+				return err
+			}
+		}
+		return s.setEmbeddingInfo(tx, EmbeddingInfo{Model: model, Dimension: dimension})
+	}
+
+	info, err := embeddingInfo(tx)
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		return s.setEmbeddingInfo(tx, EmbeddingInfo{Model: model, Dimension: dimension})
+	}
+	if info.Dimension != dimension {
+		return fmt.Errorf("embedding has %d dimensions, but the vector database holds %d-dimensional embeddings of %s; re-embed the database first",
+			dimension, info.Dimension, info.Model)
+	}
+	if normalizeModelName(info.Model) != normalizeModelName(model) {
+		return fmt.Errorf("the vector database holds embeddings of %s, not %s; re-embed the database first", info.Model, model)
+	}
+	return nil
+}
+
+// beginReembedding creates an empty staging table for embeddings of a new model.
+func (s *VectorService) beginReembedding(dimension int) error {
+	if _, err := s.db.Exec("DROP TABLE IF EXISTS vectors_reembed"); err != nil {
+		return fmt.Errorf("failed to drop staging table: %w", err)
+	}
+	_, err := s.db.Exec(fmt.Sprintf("CREATE TABLE vectors_reembed (id INTEGER PRIMARY KEY, embedding F32_BLOB(%d))", dimension))
+	if err != nil {
+		return fmt.Errorf("failed to create staging table: %w", err)
+	}
+	return nil
+}
+
+// stageReembedding stores the new embeddings of chunks in the staging table.
+func (s *VectorService) stageReembedding(ids []int64, embeddings [][]float32) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for i, id := range ids {
+		_, err := tx.Exec("INSERT OR REPLACE INTO vectors_reembed (id, embedding) VALUES (?, vector32(?))", id, vectorString(embeddings[i]))
+		if err != nil {
+			return fmt.Errorf("failed to stage embedding of chunk %d: %w", id, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// errChunksNotStaged is returned by finishReembedding if chunks without a staged embedding are stored.
+var errChunksNotStaged = errors.New("chunks were stored without a new embedding while re-embedding")
+
+// finishReembedding atomically replaces the vectors table with one holding the staged embeddings. The table is
+// kept with errChunksNotStaged if a chunk has no staged embedding, e.g. one stored while re-embedding, as it would
+// be lost otherwise.
+func (s *VectorService) finishReembedding(info EmbeddingInfo) error {
+	s.vectorsMu.Lock()
+	defer s.vectorsMu.Unlock()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var unstaged int
+	err = tx.QueryRow("SELECT COUNT(*) FROM vectors v LEFT JOIN vectors_reembed r ON r.id = v.id WHERE r.id IS NULL").Scan(&unstaged)
+	if err != nil {
+		return fmt.Errorf("failed to check staged embeddings: %w", err)
+	}
+	if unstaged > 0 {
+		return fmt.Errorf("%w (%d chunks)", errChunksNotStaged, unstaged)
+	}
+
+	statements := []string{
+		"DROP TABLE IF EXISTS vectors_new",
+		vectorTableSchema("vectors_new", info.Dimension),
+		fmt.Sprintf(`INSERT INTO vectors_new (%[1]s, embedding)
+			SELECT %[2]s, r.embedding FROM vectors v JOIN vectors_reembed r ON r.id = v.id`, vectorColumns, prefixColumns("v", vectorColumns)),
+		"DROP TABLE vectors",
+		"ALTER TABLE vectors_new RENAME TO vectors",
+		"DROP TABLE vectors_reembed",
+		// The chunks keep their ids, only chunks deleted in the meantime have to leave the full-text index
+		"DELETE FROM vectors_fts WHERE rowid NOT IN (SELECT id FROM vectors)",
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return fmt.Errorf("failed to replace vectors table: %w", err)
+		}
+	}
+	if err := createVectorIndexes(tx); err != nil {
+		return err
+	}
+	if err := s.setEmbeddingInfo(tx, info); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// listChunks returns the ids and texts of all stored chunks.
+func (s *VectorService) listChunks() ([]int64, []string, error) {
+	return s.listChunksWhere("1=1")
+}
+
+// listChunksWhere returns the ids and texts of the stored chunks matching an SQL condition.
+func (s *VectorService) listChunksWhere(condition string, args ...any) ([]int64, []string, error) {
+	rows, err := s.db.Query("SELECT id, text FROM vectors WHERE "+condition+" ORDER BY id ASC", args...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list chunks: %w", err)
+	}
+	defer rows.Close()
+
+	var (
+		ids   []int64
+		texts []string
+	)
+	for rows.Next() {
+		var (
+			id   int64
+			text string
+		)
+		if err := rows.Scan(&id, &text); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan chunk: %w", err)
+		}
+		ids = append(ids, id)
+		texts = append(texts, text)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to list chunks: %w", err)
+	}
+	return ids, texts, nil
+}
+
+// prefixColumns qualifies a comma separated column list with a table alias.
+func prefixColumns(alias string, columns string) string {
+	parts := strings.Split(columns, ",")
+	for i, part := range parts {
+		parts[i] = alias + "." + strings.TrimSpace(part)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// vectorString formats an embedding as the textual vector literal expected by vector32().
+func vectorString(embedding []float32) string {
+	var sb strings.Builder
+	sb.WriteByte('[')
+	for i, v := range embedding {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(strconv.FormatFloat(float64(v), 'f', 6, 32))
+	}
+	sb.WriteByte(']')
+	return sb.String()
+}
+
 func (s *VectorService) createSettingsTable() error {
 	// Create table if not exists
 	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS settings (
@@ -131,45 +579,185 @@ func (s *VectorService) createSettingsTable() error {
 		}
 	}
 
+	// Columns added after the first release, so existing databases get them as well
+	if err := s.addColumnIfMissing("settings", "history_turns", "INTEGER NOT NULL DEFAULT 10"); err != nil {
+		return err
+	}
+	if err := s.addColumnIfMissing("settings", "history_tokens", "INTEGER NOT NULL DEFAULT 2048"); err != nil {
+		return err
+	}
+	if err := s.addColumnIfMissing("settings", "top_k", "INTEGER NOT NULL DEFAULT 3"); err != nil {
+		return err
+	}
+	if err := s.addColumnIfMissing("settings", "max_distance", "REAL NOT NULL DEFAULT 1.0"); err != nil {
+		return err
+	}
+	if err := s.addColumnIfMissing("settings", "retrieval_mode", "TEXT NOT NULL DEFAULT 'vector'"); err != nil {
+		return err
+	}
+	if err := s.addColumnIfMissing("settings", "embed_batch_size", "INTEGER NOT NULL DEFAULT 32"); err != nil {
+		return err
+	}
+	if err := s.addColumnIfMissing("settings", "embed_workers", "INTEGER NOT NULL DEFAULT 2"); err != nil {
+		return err
+	}
+	if err := s.addColumnIfMissing("settings", "embed_cache_size", "INTEGER NOT NULL DEFAULT 10000"); err != nil {
+		return err
+	}
+	if err := s.addColumnIfMissing("settings", "provider", "TEXT NOT NULL DEFAULT 'ollama'"); err != nil {
+		return err
+	}
+	if err := s.addColumnIfMissing("settings", "api_key", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := s.addColumnIfMissing("settings", "vision_model", "TEXT NOT NULL DEFAULT 'llama3.2-vision:latest'"); err != nil {
+		return err
+	}
+	if err := s.addColumnIfMissing("settings", "max_image_size", "INTEGER NOT NULL DEFAULT 10"); err != nil {
+		return err
+	}
+
 	return nil
 }
 
-// StoreChunkAndEmbedding saves a text chunk and its embedding to the SQLite vector database.
-func (s *VectorService) StoreChunkAndEmbedding(chunk string, embedding []float32) error {
+func (s *VectorService) createConversationTables() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS conversations (
+		id INTEGER PRIMARY KEY,
+		title TEXT NOT NULL,
+		created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		updated_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+	) STRICT`)
+	if err != nil {
+		return fmt.Errorf("failed to create conversations table: %w", err)
+	}
+
+	_, err = s.db.Exec(`CREATE TABLE IF NOT EXISTS messages (
+		id INTEGER PRIMARY KEY,
+		conversation_id INTEGER NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+		role TEXT NOT NULL,
+		content TEXT NOT NULL,
+		created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+	) STRICT`)
+	if err != nil {
+		return fmt.Errorf("failed to create messages table: %w", err)
+	}
+
+	_, err = s.db.Exec("CREATE INDEX IF NOT EXISTS messages_conversation_idx ON messages (conversation_id, id)")
+	if err != nil {
+		return fmt.Errorf("failed to create messages index: %w", err)
+	}
+
+	return nil
+}
+
+// addColumnIfMissing adds a column to an existing table, unless the table already has it.
+func (s *VectorService) addColumnIfMissing(table string, column string, definition string) error {
+	rows, err := s.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("failed to read columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid          int
+			name         string
+			columnType   string
+			notNull      int
+			defaultValue sql.NullString
+			primaryKey   int
+		)
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &primaryKey); err != nil {
+			return fmt.Errorf("failed to scan columns of %s: %w", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read columns of %s: %w", table, err)
+	}
+	rows.Close()
+
+	_, err = s.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("failed to add column %s to %s: %w", column, table, err)
+	}
+	return nil
+}
+
+// StoreChunkAndEmbedding saves a text chunk of a document and its embedding, created by the given model, to the
+// SQLite vector database and its full-text index. The title names the source of the chunk; without one, the start of the chunk is used.
+// A chunk whose normalized text is already stored is skipped with ErrDuplicateChunk.
+func (s *VectorService) StoreChunkAndEmbedding(documentID int64, title string, chunk string, embedding []float32, model string) error {
 	if s.db == nil {
 		return fmt.Errorf("database connection is nil")
 	}
 
-	title := chunk
-	if len(chunk) > 8 {
-		title = chunk[:8]
+	s.vectorsMu.Lock()
+	defer s.vectorsMu.Unlock()
+
+	hash := chunkHash(chunk)
+	known, err := s.knownChunkHashes([]string{hash}, 0)
+	if err != nil {
+		return err
+	}
+	if known[hash] {
+		return ErrDuplicateChunk
 	}
 
-	var sb strings.Builder
-	sb.WriteByte('[')
-	for i, v := range embedding {
-		if i > 0 {
-			sb.WriteString(", ")
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := s.ensureEmbeddingCompatible(tx, model, len(embedding)); err != nil {
+		return err
+	}
+	if err := s.storeChunk(tx, documentID, title, chunk, hash, embedding); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// storeChunk inserts a chunk whose embedding was already checked by ensureEmbeddingCompatible.
+func (s *VectorService) storeChunk(executor sqlExecutor, documentID int64, title string, chunk string, hash string, embedding []float32) error {
+	if title == "" {
+		title = chunk
+		if len(chunk) > 8 {
+			title = chunk[:8]
 		}
-		sb.WriteString(strconv.FormatFloat(float64(v), 'f', 6, 32))
 	}
-	sb.WriteByte(']')
-	vectorStr := sb.String()
 
-	_, err := s.db.Exec(
-		`INSERT INTO vectors (title, text, embedding) 
-         VALUES (?, ?, vector32(?))`,
+	vectorStr := vectorString(embedding)
+
+	result, err := executor.Exec(
+		`INSERT INTO vectors (document_id, title, text, content_hash, embedding) 
+         VALUES (?, ?, ?, ?, vector32(?))`,
+		documentID,
 		title,
 		chunk,
+		hash,
 		vectorStr,
 	)
 	if err != nil {
 		return err
 	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to get id of stored chunk: %w", err)
+	}
+
+	// Keep the full-text index of the chunk in sync for keyword search
+	_, err = executor.Exec("INSERT INTO vectors_fts (rowid, text) VALUES (?, ?)", id, chunk)
+	if err != nil {
+		return fmt.Errorf("failed to index chunk for keyword search: %w", err)
+	}
 	return nil
 }
 
-// chunkText chunks a string of text into smaller overlapping text chunks based on sentences.
+// ChunkText chunks a string of text into smaller overlapping text chunks based on sentences.
 //
 // Parameters:
 //
@@ -181,180 +769,108 @@ func (s *VectorService) StoreChunkAndEmbedding(chunk string, embedding []float32
 //
 //	[]string:  A slice of strings, where each string is a chunk of text (composed of sentences).
 //	error:     An error if the input parameters are invalid.
+//
+// Other chunking strategies are available through NewChunker.
 func (s *VectorService) ChunkText(text string, chunkSize int, chunkOverlap int) ([]string, error) {
-	if chunkSize <= 0 {
-		return nil, fmt.Errorf("chunkSize must be greater than 0")
-	}
-	if chunkOverlap < 0 {
-		return nil, fmt.Errorf("chunkOverlap must be non-negative")
-	}
-	if chunkOverlap >= chunkSize {
-		return nil, fmt.Errorf("chunkOverlap must be less than chunkSize")
-	}
-
-	sentences := splitIntoSentences(text) // Split text into sentences
-	if len(sentences) == 0 {
-		return []string{}, nil // Return empty slice for empty input text
-	}
-
-	var chunks []string
-	step := chunkSize - chunkOverlap
-
-	for i := 0; i < len(sentences); i += step {
-		end := i + chunkSize
-		if end > len(sentences) {
-			end = len(sentences) // Adjust end for the last chunk
-		}
-		chunkSentences := sentences[i:end]
-		chunk := strings.Join(chunkSentences, " ") // Join sentences in the chunk back into a string
-		chunks = append(chunks, chunk)
-	}
-
-	return chunks, nil
-}
-
-// splitIntoSentences splits a text into sentences using a simple regex.
-// Note: This is a basic sentence splitter and might not be perfect for all cases.
-// For more robust sentence splitting, consider using NLP libraries.
-func splitIntoSentences(text string) []string {
-	// Use a regex to split by sentence-ending punctuation (. ! ?) followed by whitespace
-	sentenceRegex := regexp.MustCompile(`(?P<sentence>[^.!?]+[.!?])\s+`) // Improved regex
-
-	var sentences []string
-	matches := sentenceRegex.FindAllStringSubmatch(text, -1)
-	if matches == nil {
-		// Handle case where no sentences are found using the regex (e.g., very short text)
-		sentences = strings.Split(text, ". ") // Fallback to simple split if regex fails
-		if len(sentences) <= 1 {              // If still only one or zero sentences after simple split
-			sentences = strings.Split(text, "\n") // Try splitting by newline as a last resort
-			if len(sentences) <= 1 {
-				sentences = []string{text} // If all else fails, treat the whole text as one sentence
-			}
-		}
-		return sentences
-
-	}
-	for _, match := range matches {
-		sentences = append(sentences, strings.TrimSpace(match[1])) // match[1] is the captured sentence group
-	}
-
-	// Handle the last part of the text that might not end with sentence-ending punctuation
-	lastSentence := sentenceRegex.ReplaceAllString(text, "")
-	lastSentence = strings.TrimSpace(lastSentence)
-	if lastSentence != "" {
-		sentences = append(sentences, lastSentence)
+	chunker, err := NewChunker(ChunkOptions{Strategy: ChunkSentences, Size: chunkSize, Overlap: chunkOverlap})
+	if err != nil {
+		return nil, err
 	}
-
-	return sentences
+	return chunker.Chunk(text), nil
 }
 
-// ReadAllVectors reads all data from the vector DB table.
-func (s *VectorService) ReadAllVectors() (string, error) {
+// FindSimilarVectors queries the vector DB for the options.TopK vectors most similar to the given embedding,
+// leaving out those further away than options.MaxDistance.
+func (s *VectorService) FindSimilarVectors(queryEmbedding []float32, options RetrievalOptions) ([]VectorItem, error) {
 	if s.db == nil {
-		return "", fmt.Errorf("database connection is nil")
+		return nil, fmt.Errorf("database connection is nil in VectorService")
 	}
 
-	var builder strings.Builder
-	const (
-		maxTextLength  = 40
-		maxEmbedLength = 40
-	)
-
-	rows, err := s.db.Query(`
-		SELECT id, title, text, vector_extract(embedding) 
-		FROM vectors
-		ORDER BY id ASC`)
+	info, err := s.GetEmbeddingInfo()
 	if err != nil {
-		return "", fmt.Errorf("query failed: %w", err)
+		return nil, err
+	}
+	if info == nil {
+		return nil, nil // Nothing stored yet
+	}
+	if info.Dimension != len(queryEmbedding) {
+		return nil, fmt.Errorf("query embedding has %d dimensions, but the vector database holds %d-dimensional embeddings of %s",
+			len(queryEmbedding), info.Dimension, info.Model)
 	}
-	defer rows.Close()
-
-	var (
-		id        int
-		title     string
-		text      string
-		embedding string
-	)
 
-	for rows.Next() {
-		err := rows.Scan(&id, &title, &text, &embedding)
+	strategy := options.Strategy
+	if strategy == SearchAuto {
+		count, err := countVectors(s.db)
 		if err != nil {
-			return builder.String(), fmt.Errorf("scan failed: %w", err)
+			return nil, err
 		}
-
-		// Truncate fields
-		displayText := text
-		if len(text) > maxTextLength {
-			displayText = text[:maxTextLength-3] + "..."
+		strategy = SearchIndexed
+		if count < indexedSearchThreshold {
+			strategy = SearchBruteForce
 		}
-
-		builder.WriteString(fmt.Sprintf("%-4d - %-40s | ", id, displayText))
 	}
 
-	if err := rows.Err(); err != nil {
-		return builder.String(), fmt.Errorf("row iteration error: %w", err)
+	vectorStr := vectorString(queryEmbedding)
+	if strategy == SearchIndexed {
+		items, err := s.findSimilarVectorsIndexed(vectorStr, options)
+		if err == nil || options.Strategy == SearchIndexed {
+			return items, err
+		}
+		log.Printf("Vector index search failed, falling back to a full scan: %v\n", err)
 	}
-
-	return builder.String(), nil
+	return s.findSimilarVectorsBruteForce(vectorStr, options)
 }
 
-// FindSimilarVectors queries the vector DB for vectors similar to the given embedding.
-func (s *VectorService) FindSimilarVectors(queryEmbedding []float32) ([]VectorItem, error) {
-	if s.db == nil {
-		return nil, fmt.Errorf("database connection is nil in VectorService")
-	}
-
-	var sb strings.Builder
-	sb.WriteByte('[')
-	for i, v := range queryEmbedding {
-		if i > 0 {
-			sb.WriteString(", ")
-		}
-		sb.WriteString(strconv.FormatFloat(float64(v), 'f', 6, 32))
+// findSimilarVectorsIndexed looks up the nearest neighbours in the DiskANN index. The index is approximate,
+// so it may miss a close vector now and then, but it does not have to read every stored embedding.
+func (s *VectorService) findSimilarVectorsIndexed(vectorStr string, options RetrievalOptions) ([]VectorItem, error) {
+	rows, err := s.db.Query(
+		`SELECT v.id, COALESCE(v.document_id, 0), v.title, v.text, vector_extract(v.embedding),
+       vector_distance_cos(v.embedding, vector32(?)) AS distance
+		FROM vector_top_k('vectors_embedding_idx', vector32(?), ?) AS top
+		JOIN vectors v ON v.id = top.id
+		WHERE distance <= ?
+		ORDER BY distance ASC;`, vectorStr, vectorStr, options.TopK, options.MaxDistance)
+	if err != nil {
+		return nil, err
 	}
-	sb.WriteByte(']')
-	vectorStr := sb.String()
+	return scanSimilarVectors(rows)
+}
 
+// findSimilarVectorsBruteForce compares the query with every stored embedding, which is exact.
+func (s *VectorService) findSimilarVectorsBruteForce(vectorStr string, options RetrievalOptions) ([]VectorItem, error) {
 	rows, err := s.db.Query(
-		`SELECT title, text, vector_extract(embedding),
+		`SELECT id, COALESCE(document_id, 0), title, text, vector_extract(embedding),
        vector_distance_cos(embedding, vector32(?))
 		FROM vectors
+		WHERE vector_distance_cos(embedding, vector32(?)) <= ?
 		ORDER BY
        vector_distance_cos(embedding, vector32(?))
-		ASC LIMIT 3;`, vectorStr, vectorStr)
+		ASC LIMIT ?;`, vectorStr, vectorStr, options.MaxDistance, vectorStr, options.TopK)
 	if err != nil {
 		return nil, err
 	}
+	return scanSimilarVectors(rows)
+}
 
+func scanSimilarVectors(rows *sql.Rows) ([]VectorItem, error) {
 	defer rows.Close()
 
-	// Iterate through results
-	var (
-		title     string
-		text      string
-		embedding string
-		distance  float64
-	)
-
 	var similarItems []VectorItem
 	for rows.Next() {
-		err := rows.Scan(&title, &text, &embedding, &distance)
+		var (
+			item      VectorItem
+			embedding string
+		)
+		err := rows.Scan(&item.ID, &item.DocumentID, &item.Title, &item.Text, &embedding, &item.Distance)
 		if err != nil {
 			return nil, err
 		}
-
-		// Format the output
-		fmt.Printf("%-20s | %.4f\n",
-			text,
-			distance)
-		item := VectorItem{
-			Text:      text,
-			Embedding: []byte(embedding),
-		}
+		item.Embedding = []byte(embedding)
 		similarItems = append(similarItems, item)
 	}
 
-	if err = rows.Err(); err != nil {
+	if err := rows.Err(); err != nil {
 		return nil, err
 	}
 
@@ -363,17 +879,194 @@ func (s *VectorService) FindSimilarVectors(queryEmbedding []float32) ([]VectorIt
 
 func (s *VectorService) GetSettings() (*Settings, error) {
 	var settings Settings
-	err := s.db.QueryRow("SELECT url, llm, embedding_model FROM settings").Scan(&settings.URL, &settings.LLM, &settings.Embedding)
+	err := s.db.QueryRow(`SELECT provider, url, api_key, llm, embedding_model, vision_model, history_turns, history_tokens, top_k,
+		max_distance, retrieval_mode, embed_batch_size, embed_workers, embed_cache_size, max_image_size FROM settings`).Scan(
+		&settings.Provider, &settings.URL, &settings.APIKey, &settings.LLM, &settings.Embedding, &settings.VisionModel,
+		&settings.HistoryTurns, &settings.HistoryTokens, &settings.TopK, &settings.MaxDistance, &settings.RetrievalMode, &settings.EmbedBatch, &settings.EmbedWorkers,
+		&settings.EmbedCache, &settings.MaxImageSize)
 	if err != nil {
 		return nil, err
 	}
 	return &settings, nil
 }
 
-func (s *VectorService) UpdateSettings(url string, llm string, embedding string) error {
-	_, err := s.db.Exec("UPDATE settings SET url=?, llm=?, embedding_model=? WHERE id=1", url, llm, embedding)
+func (s *VectorService) UpdateSettings(settings Settings) error {
+	_, err := s.db.Exec(`UPDATE settings SET provider=?, url=?, api_key=?, llm=?, embedding_model=?, vision_model=?,
+		history_turns=?, history_tokens=?, top_k=?, max_distance=?, retrieval_mode=?, embed_batch_size=?, embed_workers=?,
+		embed_cache_size=?, max_image_size=? WHERE id=1`,
+		settings.Provider, settings.URL, settings.APIKey, settings.LLM, settings.Embedding, settings.VisionModel,
+		settings.HistoryTurns, settings.HistoryTokens, settings.TopK, settings.MaxDistance, settings.RetrievalMode, settings.EmbedBatch, settings.EmbedWorkers,
+		settings.EmbedCache, settings.MaxImageSize)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ListConversations returns all conversations, most recently used first.
+func (s *VectorService) ListConversations() ([]Conversation, error) {
+	rows, err := s.db.Query("SELECT id, title, created_at, updated_at FROM conversations ORDER BY updated_at DESC, id DESC")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list conversations: %w", err)
+	}
+	defer rows.Close()
+
+	var conversations []Conversation
+	for rows.Next() {
+		var conversation Conversation
+		if err := rows.Scan(&conversation.ID, &conversation.Title, &conversation.CreatedAt, &conversation.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan conversation: %w", err)
+		}
+		conversations = append(conversations, conversation)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list conversations: %w", err)
+	}
+	return conversations, nil
+}
+
+// RenameConversation changes the title of a conversation.
+func (s *VectorService) RenameConversation(id int64, title string) error {
+	result, err := s.db.Exec("UPDATE conversations SET title=? WHERE id=?", title, id)
+	if err != nil {
+		return fmt.Errorf("failed to rename conversation: %w", err)
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return fmt.Errorf("conversation %d not found", id)
+	}
+	return nil
+}
+
+// DeleteConversation deletes a conversation together with all of its messages.
+func (s *VectorService) DeleteConversation(id int64) error {
+	tx, err := s.db.Begin()
 	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM messages WHERE conversation_id=?", id); err != nil {
+		return fmt.Errorf("failed to delete messages: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM conversations WHERE id=?", id); err != nil {
+		return fmt.Errorf("failed to delete conversation: %w", err)
+	}
+	return tx.Commit()
+}
+
+// StartConversation creates a conversation with the given title together with its first messages, e.g. the first
+// question with its answer, so no conversation is left empty.
+func (s *VectorService) StartConversation(title string, messages ...ChatMessage) (*Conversation, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var conversation Conversation
+	err = tx.QueryRow(`INSERT INTO conversations (title) VALUES (?)
+		RETURNING id, title, created_at, updated_at`, title).Scan(
+		&conversation.ID, &conversation.Title, &conversation.CreatedAt, &conversation.UpdatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create conversation: %w", err)
+	}
+	if err := addMessages(tx, conversation.ID, messages); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit conversation: %w", err)
+	}
+	return &conversation, nil
+}
+
+// AddMessages appends messages to a conversation, all or none of them, e.g. a question together with its answer.
+func (s *VectorService) AddMessages(conversationID int64, messages ...ChatMessage) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := addMessages(tx, conversationID, messages); err != nil {
 		return err
 	}
+	return tx.Commit()
+}
+
+func addMessages(executor sqlExecutor, conversationID int64, messages []ChatMessage) error {
+	for _, message := range messages {
+		_, err := executor.Exec("INSERT INTO messages (conversation_id, role, content) VALUES (?, ?, ?)",
+			conversationID, message.Role, message.Content)
+		if err != nil {
+			return fmt.Errorf("failed to store message: %w", err)
+		}
+	}
+	_, err := executor.Exec("UPDATE conversations SET updated_at=CURRENT_TIMESTAMP WHERE id=?", conversationID)
+	if err != nil {
+		return fmt.Errorf("failed to update conversation: %w", err)
+	}
 	return nil
 }
+
+// GetConversationMessages returns all messages of a conversation in chronological order.
+func (s *VectorService) GetConversationMessages(conversationID int64) ([]ChatMessage, error) {
+	rows, err := s.db.Query("SELECT role, content FROM messages WHERE conversation_id=? ORDER BY id ASC", conversationID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read messages: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []ChatMessage
+	for rows.Next() {
+		var message ChatMessage
+		if err := rows.Scan(&message.Role, &message.Content); err != nil {
+			return nil, fmt.Errorf("failed to scan message: %w", err)
+		}
+		messages = append(messages, message)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read messages: %w", err)
+	}
+	return messages, nil
+}
+
+// GetConversationHistory returns the most recent messages of a conversation that fit into the given budget
+// of question/answer turns and (roughly estimated) tokens, in chronological order.
+func (s *VectorService) GetConversationHistory(conversationID int64, maxTurns int, maxTokens int) ([]ChatMessage, error) {
+	messages, err := s.GetConversationMessages(conversationID)
+	if err != nil {
+		return nil, err
+	}
+	return trimHistory(messages, maxTurns, maxTokens), nil
+}
+
+// trimHistory returns the most recent messages that fit into the given budget of question/answer turns and
+// (roughly estimated) tokens. Turns are kept or dropped whole, so the history never starts with an answer
+// whose question was cut off.
+func trimHistory(messages []ChatMessage, maxTurns int, maxTokens int) []ChatMessage {
+	// Walk backwards from the newest turn and stop once a budget is exhausted
+	start := len(messages)
+	tokens := 0
+	for turns := 0; turns < maxTurns; turns++ {
+		turnStart := start - 1
+		for turnStart >= 0 && messages[turnStart].Role != "user" {
+			turnStart--
+		}
+		if turnStart < 0 {
+			break
+		}
+		for _, message := range messages[turnStart:start] {
+			tokens += estimateTokens(message.Content)
+		}
+		if tokens > maxTokens {
+			break
+		}
+		start = turnStart
+	}
+	return messages[start:]
+}
+
+// estimateTokens roughly estimates the number of tokens in a text, assuming ~4 characters per token.
+func estimateTokens(text string) int {
+	return (len(text) + 3) / 4
+}
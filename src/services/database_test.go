@@ -0,0 +1,144 @@
+package services
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newTestVectorService creates a vector service with a fresh database.
+func newTestVectorService(t *testing.T) *VectorService {
+	t.Helper()
+	service, err := SetUDatabaseService(filepath.Join(t.TempDir(), "test.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { service.Close() })
+	return service
+}
+
+// insertTestDocument inserts an empty document to store chunks of.
+func insertTestDocument(t *testing.T, s *VectorService) int64 {
+	t.Helper()
+	var documentID int64
+	err := s.db.QueryRow(`INSERT INTO documents (name, source, content_hash, content, chunk_strategy, chunk_size, chunk_overlap)
+		VALUES ('Test', 'test', '', '', 'sentence', 1, 0) RETURNING id`).Scan(&documentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return documentID
+}
+
+func TestEnsureEmbeddingCompatibleRollsBack(t *testing.T) {
+	s := newTestVectorService(t)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ensureEmbeddingCompatible(tx, "small-model", 3); err != nil {
+		t.Fatal(err)
+	}
+	if dimension, err := vectorTableDimension(tx, "vectors"); err != nil || dimension != 3 {
+		t.Fatalf("dimension within the transaction = %d (%v), want 3", dimension, err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	dimension, err := vectorTableDimension(s.db, "vectors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dimension != defaultEmbeddingDimension {
+		t.Errorf("dimension after rollback = %d, want %d", dimension, defaultEmbeddingDimension)
+	}
+	if info, err := s.GetEmbeddingInfo(); err != nil || info != nil {
+		t.Errorf("embedding info after rollback = %+v (%v), want none", info, err)
+	}
+}
+
+func TestStoreChunkAndEmbeddingConcurrentDimensions(t *testing.T) {
+	s := newTestVectorService(t)
+
+	documentID := insertTestDocument(t, s)
+
+	// Two writers race to adapt the empty table to their dimension. Whichever comes first wins, the other
+	// one is refused instead of rebuilding the table under it.
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, dimension := range []int{3, 5} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			embedding := make([]float32, dimension)
+			embedding[0] = 1
+			errs[i] = s.StoreChunkAndEmbedding(documentID, "", strings.Repeat("chunk ", dimension), embedding, "model")
+		}()
+	}
+	wg.Wait()
+
+	info, err := s.GetEmbeddingInfo()
+	if err != nil || info == nil {
+		t.Fatalf("embedding info = %+v (%v), want the winner's", info, err)
+	}
+	dimension, err := vectorTableDimension(s.db, "vectors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := countVectors(s.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dimension != info.Dimension {
+		t.Errorf("table dimension %d doesn't match the embedding info %+v", dimension, info)
+	}
+
+	stored := 0
+	for _, err := range errs {
+		if err == nil {
+			stored++
+		} else if !strings.Contains(err.Error(), "dimensions") {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if stored != 1 || count != 1 {
+		t.Errorf("%d chunks stored, %d writers succeeded (%v), want exactly one", count, stored, errs)
+	}
+}
+
+func TestTrimHistory(t *testing.T) {
+	question := func(content string) ChatMessage { return ChatMessage{Role: "user", Content: content} }
+	answer := func(content string) ChatMessage { return ChatMessage{Role: "assistant", Content: content} }
+	// Messages are estimated at one token per four characters: the turns take 2, 3 and 2 tokens
+	history := []ChatMessage{question("Q1.."), answer("A1.."), question("Q2.."), answer("A2......"), question("Q3.."), answer("A3..")}
+
+	tests := []struct {
+		name      string
+		messages  []ChatMessage
+		maxTurns  int
+		maxTokens int
+		want      []ChatMessage
+	}{
+		{name: "everything fits", messages: history, maxTurns: 5, maxTokens: 100, want: history},
+		{name: "turn limit", messages: history, maxTurns: 2, maxTokens: 100, want: history[2:]},
+		{name: "no turns", messages: history, maxTurns: 0, maxTokens: 100, want: history[6:]},
+		{name: "token limit", messages: history, maxTurns: 5, maxTokens: 5, want: history[2:]},
+		{name: "only the answer of a turn fits", messages: history, maxTurns: 5, maxTokens: 4, want: history[4:]},
+		{name: "no turn fits", messages: history, maxTurns: 5, maxTokens: 1, want: history[6:]},
+		{name: "answer without question", messages: []ChatMessage{answer("A0.."), question("Q1.."), answer("A1..")}, maxTurns: 5, maxTokens: 100,
+			want: []ChatMessage{question("Q1.."), answer("A1..")}},
+		{name: "empty", messages: nil, maxTurns: 5, maxTokens: 100, want: nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := trimHistory(test.messages, test.maxTurns, test.maxTokens)
+			if len(got) != len(test.want) || (len(got) > 0 && !reflect.DeepEqual(got, test.want)) {
+				t.Errorf("history = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// ErrDuplicateChunk is returned when a chunk with the same normalized text is already stored.
+var ErrDuplicateChunk = errors.New("chunk is already stored")
+
+// hashLookupSize is the number of hashes looked up per query, well below SQLite's limit of bound parameters.
+const hashLookupSize = 500
+
+// chunkHash returns the hash of a chunk's text after normalization: chunks that only differ in whitespace,
+// e.g. in line breaks or indentation, have the same hash.
+func chunkHash(chunk string) string {
+	hash := sha256.Sum256([]byte(strings.Join(strings.Fields(chunk), " ")))
+	return hex.EncodeToString(hash[:])
+}
+
+// createSkippedChunksTable creates the table recording which chunks of a document were skipped, because another
+// document stores their text.
+func (s *VectorService) createSkippedChunksTable() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS skipped_chunks (
+		document_id INTEGER NOT NULL REFERENCES documents(id) ON DELETE CASCADE,
+		content_hash TEXT NOT NULL,
+		PRIMARY KEY (document_id, content_hash)
+	) STRICT`)
+	if err != nil {
+		return fmt.Errorf("failed to create skipped chunks table: %w", err)
+	}
+	return nil
+}
+
+// recordSkippedChunks records that a document skipped the chunks with the given hashes, because another document
+// stores their text.
+func recordSkippedChunks(executor sqlExecutor, documentID int64, hashes []string) error {
+	for _, hash := range hashes {
+		_, err := executor.Exec("INSERT OR IGNORE INTO skipped_chunks (document_id, content_hash) VALUES (?, ?)", documentID, hash)
+		if err != nil {
+			return fmt.Errorf("failed to record skipped chunk: %w", err)
+		}
+	}
+	return nil
+}
+
+// handOverSkippedChunks moves the chunks of a document that other documents skipped to the oldest of them, which
+// then stores the text itself.
+func handOverSkippedChunks(executor sqlExecutor, documentID int64) error {
+	_, err := executor.Exec(`UPDATE vectors SET document_id = heir.document_id, title = heir.name
+		FROM (SELECT k.content_hash, MIN(d.id) AS document_id, d.name FROM skipped_chunks k
+			JOIN documents d ON d.id = k.document_id
+			WHERE k.document_id != ?1 GROUP BY k.content_hash) AS heir
+		WHERE vectors.document_id = ?1 AND vectors.content_hash = heir.content_hash`, documentID)
+	if err != nil {
+		return fmt.Errorf("failed to hand over chunks: %w", err)
+	}
+	return forgetStoredSkippedChunks(executor)
+}
+
+// forgetStoredSkippedChunks removes the skipped chunks a document stores itself by now.
+func forgetStoredSkippedChunks(executor sqlExecutor) error {
+	_, err := executor.Exec(`DELETE FROM skipped_chunks WHERE EXISTS (SELECT 1 FROM vectors v
+		WHERE v.document_id = skipped_chunks.document_id AND v.content_hash = skipped_chunks.content_hash)`)
+	if err != nil {
+		return fmt.Errorf("failed to clean up skipped chunks: %w", err)
+	}
+	return nil
+}
+
+// knownChunkHashes returns which of the hashes belong to chunks already stored, ignoring the chunks of the
+// given document, e.g. one that is about to be re-indexed. Pass 0 to consider the chunks of all documents.
+func (s *VectorService) knownChunkHashes(hashes []string, excludeDocumentID int64) (map[string]bool, error) {
+	known := make(map[string]bool)
+	for start := 0; start < len(hashes); start += hashLookupSize {
+		batch := hashes[start:min(start+hashLookupSize, len(hashes))]
+		args := make([]any, 0, len(batch)+1)
+		for _, hash := range batch {
+			args = append(args, hash)
+		}
+		args = append(args, excludeDocumentID)
+
+		rows, err := s.db.Query(`SELECT DISTINCT content_hash FROM vectors
+			WHERE content_hash IN (?`+strings.Repeat(", ?", len(batch)-1)+`) AND document_id IS NOT ?`, args...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up chunk hashes: %w", err)
+		}
+		for rows.Next() {
+			var hash string
+			if err := rows.Scan(&hash); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan chunk hash: %w", err)
+			}
+			known[hash] = true
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up chunk hashes: %w", err)
+		}
+	}
+	return known, nil
+}
+
+// backfillChunkHashes hashes the chunks stored before chunks were deduplicated.
+func (s *VectorService) backfillChunkHashes() error {
+	ids, texts, err := s.listChunksWhere("content_hash IS NULL")
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	log.Printf("Hashing %d chunks for deduplication\n", len(ids))
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for i, id := range ids {
+		if _, err := tx.Exec("UPDATE vectors SET content_hash=? WHERE id=?", chunkHash(texts[i]), id); err != nil {
+			return fmt.Errorf("failed to hash chunk %d: %w", id, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// DeduplicateChunks deletes every chunk whose normalized text is stored already, keeping the oldest copy, and
+// records the deleted chunks as skipped by their documents. It returns the number of duplicates, which are only
+// counted if dryRun is set.
+func (s *VectorService) DeduplicateChunks(dryRun bool) (int, error) {
+	if err := s.backfillChunkHashes(); err != nil {
+		return 0, err
+	}
+
+	const duplicates = `SELECT v.id FROM vectors v
+		WHERE EXISTS (SELECT 1 FROM vectors o WHERE o.content_hash = v.content_hash AND o.id < v.id)`
+
+	var count int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM (" + duplicates + ")").Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count duplicate chunks: %w", err)
+	}
+	if dryRun || count == 0 {
+		return count, nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT OR IGNORE INTO skipped_chunks (document_id, content_hash)
+		SELECT document_id, content_hash FROM vectors WHERE document_id IS NOT NULL AND id IN (` + duplicates + ")")
+	if err != nil {
+		return 0, fmt.Errorf("failed to record duplicate chunks: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM vectors_fts WHERE rowid IN (" + duplicates + ")"); err != nil {
+		return 0, fmt.Errorf("failed to delete duplicate chunks from the full-text index: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM vectors WHERE id IN (" + duplicates + ")"); err != nil {
+		return 0, fmt.Errorf("failed to delete duplicate chunks: %w", err)
+	}
+	if err := forgetStoredSkippedChunks(tx); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit deduplication: %w", err)
+	}
+	return count, nil
+}
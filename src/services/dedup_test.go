@@ -0,0 +1,198 @@
+package services
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// ingestTestDocument ingests a text chunked into single sentences.
+func ingestTestDocument(t *testing.T, s *VectorService, ollamaService *OllamaService, name string, text string) *Document {
+	t.Helper()
+	document, err := s.IngestDocument(context.Background(), name, "test", text, ChunkOptions{Strategy: ChunkSentences, Size: 1},
+		ollamaService, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return document
+}
+
+// searchAll returns the text of every stored chunk found by a search, with the name of its document.
+func searchAll(t *testing.T, s *VectorService) map[string]string {
+	t.Helper()
+	items, err := s.SearchChunks("Two", []float32{4, 0, 1}, RetrievalOptions{TopK: 10, MaxDistance: 2, Mode: RetrievalHybrid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]string)
+	for _, item := range items {
+		found[item.Text] = item.Title
+	}
+	return found
+}
+
+func TestSharedChunksSurviveTheirDocument(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(s *VectorService, ollamaService *OllamaService, first *Document) error
+		want   map[string]string
+		// Found after deleting the second document as well, which hands the chunk back if the first one needs it
+		wantFirst map[string]string
+	}{
+		{
+			name: "document deleted",
+			change: func(s *VectorService, ollamaService *OllamaService, first *Document) error {
+				return s.DeleteDocument(first.ID)
+			},
+			want:      map[string]string{"Two.": "Second", "Three.": "Second"},
+			wantFirst: map[string]string{},
+		},
+		{
+			name: "document re-indexed without the chunk",
+			change: func(s *VectorService, ollamaService *OllamaService, first *Document) error {
+				_, err := s.ReindexDocument(context.Background(), first.ID, ChunkOptions{Strategy: ChunkSentences, Size: 2},
+					ollamaService, nil)
+				return err
+			},
+			want:      map[string]string{"One. Two.": "First", "Two.": "Second", "Three.": "Second"},
+			wantFirst: map[string]string{"One. Two.": "First"},
+		},
+		{
+			name: "document re-indexed with the chunk",
+			change: func(s *VectorService, ollamaService *OllamaService, first *Document) error {
+				_, err := s.ReindexDocument(context.Background(), first.ID, ChunkOptions{}, ollamaService, nil)
+				return err
+			},
+			want:      map[string]string{"One.": "First", "Two.": "Second", "Three.": "Second"},
+			wantFirst: map[string]string{"One.": "First", "Two.": "First"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestVectorService(t)
+			ollamaService := fakeOllamaEmbed(t)
+			first := ingestTestDocument(t, s, ollamaService, "First", "One. Two.")
+			second := ingestTestDocument(t, s, ollamaService, "Second", "Two. Three.")
+			if second.ChunkCount != 1 || second.DuplicateChunks != 1 {
+				t.Fatalf("second document has %d chunks and %d duplicates, want 1 and 1", second.ChunkCount, second.DuplicateChunks)
+			}
+
+			if err := test.change(s, ollamaService, first); err != nil {
+				t.Fatal(err)
+			}
+			if found := searchAll(t, s); !reflect.DeepEqual(found, test.want) {
+				t.Errorf("found chunks %q, want %q", found, test.want)
+			}
+
+			if err := s.DeleteDocument(second.ID); err != nil {
+				t.Fatal(err)
+			}
+			if found := searchAll(t, s); !reflect.DeepEqual(found, test.wantFirst) {
+				t.Errorf("found chunks %q after deleting the second document, want %q", found, test.wantFirst)
+			}
+		})
+	}
+}
+
+func TestKnownChunkHashes(t *testing.T) {
+	s := newTestVectorService(t)
+	ollamaService := fakeOllamaEmbed(t)
+	first := ingestTestDocument(t, s, ollamaService, "First", "One. Two.")
+	second := ingestTestDocument(t, s, ollamaService, "Second", "Three.")
+
+	hashes := []string{chunkHash("One."), chunkHash("  Two. \n"), chunkHash("Three."), chunkHash("Four.")}
+	tests := []struct {
+		name    string
+		exclude int64
+		want    map[string]bool
+	}{
+		{name: "all documents", exclude: 0, want: map[string]bool{hashes[0]: true, hashes[1]: true, hashes[2]: true}},
+		{name: "without the first document", exclude: first.ID, want: map[string]bool{hashes[2]: true}},
+		{name: "without the second document", exclude: second.ID, want: map[string]bool{hashes[0]: true, hashes[1]: true}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			known, err := s.knownChunkHashes(hashes, test.exclude)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(known, test.want) {
+				t.Errorf("known = %v, want %v", known, test.want)
+			}
+		})
+	}
+
+	// More hashes than are looked up per query
+	many := make([]string, hashLookupSize+1)
+	for i := range many {
+		many[i] = "unknown"
+	}
+	many[hashLookupSize] = hashes[2]
+	if known, err := s.knownChunkHashes(many, 0); err != nil || !reflect.DeepEqual(known, map[string]bool{hashes[2]: true}) {
+		t.Errorf("known = %v (%v), want the hash of the second batch", known, err)
+	}
+}
+
+func TestDeduplicateChunks(t *testing.T) {
+	s := newTestVectorService(t)
+	first := insertTestDocument(t, s)
+	second := insertTestDocument(t, s)
+
+	// Stored before chunks were deduplicated: without hashes and with duplicates. StoreChunkAndEmbedding refuses
+	// duplicates, so only the first chunk goes through it.
+	if err := s.StoreChunkAndEmbedding(first, "", "One.", []float32{1, 0, 1}, "model"); err != nil {
+		t.Fatal(err)
+	}
+	for i, chunk := range []struct {
+		documentID int64
+		text       string
+	}{
+		{first, "Two."}, {first, "One."}, {second, "Two.\n"}, {second, "Three."},
+	} {
+		if err := s.storeChunk(s.db, chunk.documentID, "", chunk.text, "", []float32{float32(i + 2), 0, 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.db.Exec("UPDATE vectors SET content_hash=NULL"); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := s.DeduplicateChunks(true)
+	if err != nil || count != 2 {
+		t.Fatalf("dry run counted %d duplicates (%v), want 2", count, err)
+	}
+	if count, err := s.DeduplicateChunks(false); err != nil || count != 2 {
+		t.Fatalf("deleted %d duplicates (%v), want 2", count, err)
+	}
+	if count, err := s.DeduplicateChunks(false); err != nil || count != 0 {
+		t.Fatalf("found %d duplicates (%v) after deduplicating, want none", count, err)
+	}
+
+	ids, texts, err := s.listChunksWhere("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(texts)
+	if want := []string{"One.", "Three.", "Two."}; !reflect.DeepEqual(texts, want) || len(ids) != 3 {
+		t.Errorf("chunks = %q, want %q", texts, want)
+	}
+	var inIndex int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM vectors_fts").Scan(&inIndex); err != nil || inIndex != 3 {
+		t.Errorf("full-text index has %d chunks (%v), want 3", inIndex, err)
+	}
+
+	// The duplicate of the second document is kept by the first one, deleting that hands it over
+	if err := s.DeleteDocument(first); err != nil {
+		t.Fatal(err)
+	}
+	_, texts, err = s.listChunksWhere("document_id=?", second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(texts)
+	if want := []string{"Three.", "Two."}; !reflect.DeepEqual(texts, want) {
+		t.Errorf("chunks of the second document = %q, want %q", texts, want)
+	}
+}
@@ -0,0 +1,160 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ledongthuc/pdf"
+	"golang.org/x/net/html"
+)
+
+// SupportedDocumentTypes lists the file extensions that can be uploaded to the vector database.
+var SupportedDocumentTypes = []string{".txt", ".md", ".html", ".htm", ".pdf"}
+
+// ExtractDocumentText converts an uploaded document into plain text, based on its file extension.
+func ExtractDocumentText(filename string, data []byte) (string, error) {
+	var (
+		text string
+		err  error
+	)
+
+	// Indentation is meaningful in plain text and Markdown (code blocks, lists), but noise in HTML and PDF
+	extension := strings.ToLower(filepath.Ext(filename))
+	keepIndentation := extension == ".txt" || extension == ".md"
+
+	switch extension {
+	case ".txt", ".md":
+		text, err = decodePlainText(data)
+	case ".html", ".htm":
+		text, err = extractHTMLText(data)
+	case ".pdf":
+		text, err = extractPDFText(data)
+	default:
+		return "", fmt.Errorf("unsupported file type %q, supported are %s", filepath.Ext(filename), strings.Join(SupportedDocumentTypes, ", "))
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", filename, err)
+	}
+
+	text = normalizeText(text, keepIndentation)
+	if text == "" {
+		return "", fmt.Errorf("%s does not contain any text", filename)
+	}
+	return text, nil
+}
+
+func decodePlainText(data []byte) (string, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")) // UTF-8 byte order mark
+	if !utf8.Valid(data) {
+		return "", fmt.Errorf("file is not UTF-8 encoded text")
+	}
+	return string(data), nil
+}
+
+// htmlBlockElements end a line of text when converting HTML to plain text.
+var htmlBlockElements = map[string]bool{
+	"p": true, "div": true, "br": true, "li": true, "tr": true, "section": true, "article": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"pre": true, "blockquote": true, "table": true, "ul": true, "ol": true, "hr": true,
+}
+
+// htmlSkippedElements never contain readable text.
+var htmlSkippedElements = map[string]bool{
+	"head": true, "script": true, "style": true, "noscript": true, "template": true, "svg": true,
+}
+
+func extractHTMLText(data []byte) (string, error) {
+	root, err := html.Parse(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	var walk func(node *html.Node)
+	walk = func(node *html.Node) {
+		if node.Type == html.ElementNode && htmlSkippedElements[node.Data] {
+			return
+		}
+		if node.Type == html.TextNode {
+			sb.WriteString(node.Data)
+		}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+		if node.Type == html.ElementNode && htmlBlockElements[node.Data] {
+			sb.WriteString("\n")
+		}
+	}
+	walk(root)
+
+	return sb.String(), nil
+}
+
+func extractPDFText(data []byte) (text string, err error) {
+	// The PDF reader panics on some malformed files
+	defer func() {
+		if r := recover(); r != nil {
+			text, err = "", fmt.Errorf("malformed PDF: %v", r)
+		}
+	}()
+
+	reader, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	fonts := make(map[string]*pdf.Font)
+	for i := 1; i <= reader.NumPage(); i++ {
+		page := reader.Page(i)
+		if page.V.IsNull() {
+			continue
+		}
+		for _, name := range page.Fonts() { // Cache fonts, so their character maps are only parsed once
+			if _, ok := fonts[name]; !ok {
+				font := page.Font(name)
+				fonts[name] = &font
+			}
+		}
+
+		pageText, err := page.GetPlainText(fonts)
+		if err != nil {
+			return "", fmt.Errorf("failed to read page %d: %w", i, err)
+		}
+		sb.WriteString(pageText)
+		sb.WriteString("\n\n")
+	}
+
+	if strings.TrimSpace(sb.String()) == "" {
+		return "", fmt.Errorf("PDF has no text layer (scanned documents are not supported)")
+	}
+	return sb.String(), nil
+}
+
+var (
+	horizontalSpaceRegex = regexp.MustCompile(`[ \t\f\v\p{Zs}]+`)
+	blankLinesRegex      = regexp.MustCompile(`\n{3,}`)
+)
+
+// normalizeText unifies line endings and whitespace, keeping paragraphs separated by a single blank line.
+func normalizeText(text string, keepIndentation bool) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	text = strings.ReplaceAll(text, "\x00", "")
+
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if keepIndentation {
+			lines[i] = strings.TrimRight(line, " \t")
+		} else {
+			lines[i] = strings.TrimSpace(horizontalSpaceRegex.ReplaceAllString(line, " "))
+		}
+	}
+	text = strings.Join(lines, "\n")
+
+	return strings.TrimSpace(blankLinesRegex.ReplaceAllString(text, "\n\n"))
+}
@@ -0,0 +1,118 @@
+package services
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExtractDocumentText(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		data     string
+		want     string
+		wantErr  string
+	}{
+		{name: "text", filename: "notes.txt", data: "First line\r\nSecond line\r\n", want: "First line\nSecond line"},
+		{name: "byte order mark", filename: "notes.txt", data: "\xef\xbb\xbfText", want: "Text"},
+		{name: "invalid UTF-8", filename: "notes.txt", data: "Caf\xe9", wantErr: "not UTF-8 encoded"},
+		{name: "markdown indentation kept", filename: "README.md", data: "# Title\n\n    code()\n  - item  \n", want: "# Title\n\n    code()\n  - item"},
+		{name: "extension in upper case", filename: "PAGE.HTML", data: "<p>  Indented   text</p>", want: "Indented text"},
+		{name: "html", filename: "page.htm", data: "<title>Title</title><h1>Heading</h1><p>Text</p>", want: "Heading\nText"},
+		{name: "unsupported extension", filename: "table.docx", data: "Text", wantErr: `unsupported file type ".docx"`},
+		{name: "no extension", filename: "notes", data: "Text", wantErr: `unsupported file type ""`},
+		{name: "only whitespace", filename: "empty.md", data: " \n\t\n", wantErr: "empty.md does not contain any text"},
+		{name: "malformed pdf", filename: "broken.pdf", data: "%PDF-1.4\nnot really", wantErr: "failed to read broken.pdf"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			text, err := ExtractDocumentText(test.filename, []byte(test.data))
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("error = %v, want it to contain %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if text != test.want {
+				t.Errorf("text = %q, want %q", text, test.want)
+			}
+		})
+	}
+}
+
+func TestExtractHTMLText(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want string
+	}{
+		{
+			name: "head, scripts and styles removed",
+			html: "<html><head><title>Title</title><style>p { color: red }</style></head>" +
+				"<body>Visible<script>alert('hidden')</script><noscript>No script</noscript><style>.x {}</style> text</body></html>",
+			want: "Visible text",
+		},
+		{
+			name: "block elements end lines",
+			html: "<h1>Heading</h1><p>First <b>bold</b> paragraph</p><div>Second</div>Line<br>break",
+			want: "Heading\nFirst bold paragraph\nSecond\nLine\nbreak",
+		},
+		{
+			name: "lists and tables",
+			html: "<ul><li>One</li><li>Two</li></ul><table><tr><td>A</td><td>B</td></tr></table>",
+			want: "One\nTwo\n\nAB\n\n",
+		},
+		{
+			name: "entities decoded",
+			html: "<p>Fish &amp; chips &lt;3</p>",
+			want: "Fish & chips <3\n",
+		},
+		{
+			name: "inline elements joined",
+			html: "<p>A<span>B</span><a href=\"#\">C</a></p>",
+			want: "ABC\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			text, err := extractHTMLText([]byte(test.html))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if text != test.want {
+				t.Errorf("text = %q, want %q", text, test.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeText(t *testing.T) {
+	tests := []struct {
+		name            string
+		text            string
+		keepIndentation bool
+		want            string
+	}{
+		{name: "line endings", text: "a\r\nb\rc\n", want: "a\nb\nc"},
+		{name: "blank lines collapsed", text: "a\n\n\n\n\nb\n \n\t\nc", want: "a\n\nb\n\nc"},
+		{name: "spaces collapsed", text: "  a \t b  c  ", want: "a b c"},
+		{name: "null bytes removed", text: "a\x00b", want: "ab"},
+		{name: "indentation kept", text: "list:\n  - a  \n\t\tcode\t", keepIndentation: true, want: "list:\n  - a\n\t\tcode"},
+		{name: "spaces within lines kept with indentation", text: "a    b", keepIndentation: true, want: "a    b"},
+		{name: "leading whitespace of the text trimmed", text: "\n\n   a", keepIndentation: true, want: "a"},
+		{name: "only whitespace", text: " \r\n\t ", want: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := normalizeText(test.text, test.keepIndentation); got != test.want {
+				t.Errorf("text = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
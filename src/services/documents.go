@@ -0,0 +1,409 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Document is an uploaded text that was chunked into the vectors table.
+type Document struct {
+	ID            int64
+	Name          string
+	Source        string // Where the document came from, e.g. "upload" or "paste"
+	ContentHash   string
+	Content       string
+	ChunkStrategy ChunkStrategy
+	ChunkSize     int
+	ChunkOverlap  int
+	ChunkCount    int
+	CreatedAt     string
+
+	DuplicateChunks int // Chunks skipped while indexing, because their text was stored already
+}
+
+// ChunkOptions returns the options the document was chunked with.
+func (d *Document) ChunkOptions() ChunkOptions {
+	return ChunkOptions{Strategy: d.ChunkStrategy, Size: d.ChunkSize, Overlap: d.ChunkOverlap}
+}
+
+func (s *VectorService) createDocumentsTable() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS documents (
+		id INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		source TEXT NOT NULL,
+		content_hash TEXT NOT NULL,
+		content TEXT NOT NULL,
+		chunk_size INTEGER NOT NULL,
+		chunk_overlap INTEGER NOT NULL,
+		created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+	) STRICT`)
+	if err != nil {
+		return fmt.Errorf("failed to create documents table: %w", err)
+	}
+	if err := s.addColumnIfMissing("documents", "chunk_strategy", "TEXT NOT NULL DEFAULT 'sentence'"); err != nil {
+		return err
+	}
+	if err := s.createSkippedChunksTable(); err != nil {
+		return err
+	}
+
+	return s.adoptOrphanChunks()
+}
+
+// adoptOrphanChunks collects chunks stored before documents existed into a single document,
+// so they can be listed and deleted like any other upload.
+func (s *VectorService) adoptOrphanChunks() error {
+	ids, texts, err := s.listChunksWhere("document_id IS NULL")
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	log.Printf("Adopting %d chunks without document\n", len(ids))
+	content := strings.Join(texts, "\n\n")
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var documentID int64
+	options := DefaultChunkOptions(ChunkSentences)
+	err = tx.QueryRow(`INSERT INTO documents (name, source, content_hash, content, chunk_strategy, chunk_size, chunk_overlap)
+		VALUES (?, ?, ?, ?, ?, ?, ?) RETURNING id`,
+		"Imported chunks", "legacy", hashContent(content), content, options.Strategy, options.Size, options.Overlap).Scan(&documentID)
+	if err != nil {
+		return fmt.Errorf("failed to create document for orphan chunks: %w", err)
+	}
+
+	_, err = tx.Exec("UPDATE vectors SET document_id=? WHERE document_id IS NULL", documentID)
+	if err != nil {
+		return fmt.Errorf("failed to adopt orphan chunks: %w", err)
+	}
+	return tx.Commit()
+}
+
+// IngestDocument chunks a text, embeds every chunk with the configured embedding model and stores the chunks
+// together with a new document. Nothing is stored if any chunk fails to embed or ctx is cancelled before the
+// commit. onProgress, if not nil, is called with the number of embedded and total chunks.
+func (s *VectorService) IngestDocument(ctx context.Context, name string, source string, text string, options ChunkOptions,
+	ollamaService *OllamaService, onProgress func(done int, total int)) (*Document, error) {
+	chunks, err := s.chunkAndEmbed(ctx, text, options, 0, ollamaService, onProgress)
+	if err != nil {
+		return nil, err
+	}
+
+	// The transaction is rolled back as soon as ctx is cancelled
+	s.vectorsMu.Lock()
+	defer s.vectorsMu.Unlock()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := s.ensureEmbeddingCompatible(tx, chunks.model, len(chunks.embeddings[0])); err != nil {
+		return nil, err
+	}
+
+	document := Document{
+		Name:          name,
+		Source:        source,
+		ContentHash:   hashContent(text),
+		Content:       text,
+		ChunkStrategy: options.Strategy,
+		ChunkSize:     options.Size,
+		ChunkOverlap:  options.Overlap,
+	}
+	err = tx.QueryRow(`INSERT INTO documents (name, source, content_hash, content, chunk_strategy, chunk_size, chunk_overlap)
+		VALUES (?, ?, ?, ?, ?, ?, ?) RETURNING id, created_at`,
+		document.Name, document.Source, document.ContentHash, document.Content,
+		document.ChunkStrategy, document.ChunkSize, document.ChunkOverlap,
+	).Scan(&document.ID, &document.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store document: %w", err)
+	}
+
+	document.ChunkCount, err = s.storeChunks(tx, document.ID, document.Name, chunks)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit document: %w", err)
+	}
+	document.DuplicateChunks = chunks.duplicates
+	return &document, nil
+}
+
+// ReindexDocument chunks and embeds a document again, e.g. with new chunk options, and replaces its chunks.
+// Options without a strategy keep the ones the document was indexed with. The old chunks are kept if any chunk
+// fails to embed or ctx is cancelled before the commit. onProgress works like for IngestDocument.
+func (s *VectorService) ReindexDocument(ctx context.Context, id int64, options ChunkOptions, ollamaService *OllamaService,
+	onProgress func(done int, total int)) (*Document, error) {
+	document, err := s.GetDocument(id)
+	if err != nil {
+		return nil, err
+	}
+	if options.Strategy != "" {
+		document.ChunkStrategy = options.Strategy
+		document.ChunkSize = options.Size
+		document.ChunkOverlap = options.Overlap
+	}
+
+	chunks, err := s.chunkAndEmbed(ctx, document.Content, document.ChunkOptions(), id, ollamaService, onProgress)
+	if err != nil {
+		return nil, err
+	}
+
+	s.vectorsMu.Lock()
+	defer s.vectorsMu.Unlock()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// All chunks may be stored by other documents already, then there is nothing to embed
+	if len(chunks.embeddings) > 0 {
+		if err := s.ensureEmbeddingCompatible(tx, chunks.model, len(chunks.embeddings[0])); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := deleteDocumentChunks(tx, id); err != nil {
+		return nil, fmt.Errorf("failed to delete old chunks: %w", err)
+	}
+	_, err = tx.Exec("UPDATE documents SET chunk_strategy=?, chunk_size=?, chunk_overlap=? WHERE id=?",
+		document.ChunkStrategy, document.ChunkSize, document.ChunkOverlap, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update document: %w", err)
+	}
+	document.ChunkCount, err = s.storeChunks(tx, id, document.Name, chunks)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit re-index: %w", err)
+	}
+	document.DuplicateChunks = chunks.duplicates
+	return document, nil
+}
+
+// embeddedChunks are the chunks of a text that are not stored yet, together with their embeddings.
+type embeddedChunks struct {
+	texts      []string
+	hashes     []string
+	embeddings [][]float32
+	model      string   // Embedding model used
+	duplicates int      // Chunks skipped, because their text is stored already or repeated within the text
+	skipped    []string // Hashes of the chunks skipped, because another document stores their text
+}
+
+// chunkAndEmbed splits a text into chunks and embeds the ones that are not stored yet. Chunks of the
+// document with the given id, which are about to be replaced, don't count as stored. A new document (id 0)
+// whose chunks are all stored already is refused, while a re-indexed one just ends up without chunks of its own.
+func (s *VectorService) chunkAndEmbed(ctx context.Context, text string, options ChunkOptions, documentID int64,
+	ollamaService *OllamaService, onProgress func(done int, total int)) (*embeddedChunks, error) {
+	chunker, err := NewChunker(options)
+	if err != nil {
+		return nil, err
+	}
+	texts := chunker.Chunk(text)
+	if len(texts) == 0 {
+		return nil, fmt.Errorf("no text to index")
+	}
+
+	hashes := make([]string, len(texts))
+	for i, text := range texts {
+		hashes[i] = chunkHash(text)
+	}
+	stored, err := s.knownChunkHashes(hashes, documentID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Known chunks are skipped before embedding, so they cost no embedding request
+	chunks := embeddedChunks{model: ollamaService.EmbeddingModel()}
+	known := make(map[string]bool)
+	for i, hash := range hashes {
+		switch {
+		case known[hash]:
+			chunks.duplicates++
+			continue
+		case stored[hash]:
+			known[hash] = true
+			chunks.skipped = append(chunks.skipped, hash)
+			chunks.duplicates++
+			continue
+		}
+		known[hash] = true
+		chunks.texts = append(chunks.texts, texts[i])
+		chunks.hashes = append(chunks.hashes, hash)
+	}
+	if len(chunks.texts) == 0 && documentID == 0 {
+		return nil, fmt.Errorf("all %d chunks are already in the vector database", len(texts))
+	}
+	if chunks.duplicates > 0 {
+		log.Printf("Skipping %d duplicate chunks\n", chunks.duplicates)
+	}
+
+	var onEmbedded func(done int)
+	if onProgress != nil {
+		onProgress(0, len(chunks.texts))
+		onEmbedded = func(done int) { onProgress(done, len(chunks.texts)) }
+	}
+
+	if len(chunks.texts) == 0 {
+		return &chunks, nil
+	}
+	chunks.embeddings, err = ollamaService.EmbedBatch(ctx, chunks.texts, onEmbedded)
+	if err != nil {
+		return nil, err
+	}
+	return &chunks, nil
+}
+
+// storeChunks inserts the chunks of a document within the given transaction and records the chunks skipped
+// because another document stores their text, see recordSkippedChunks. Chunks another document stored since
+// they were embedded, e.g. one handed over by deleteDocumentChunks, are skipped as well. It returns the number
+// of chunks stored. The vectors table must already match the embedding dimension, see ensureEmbeddingCompatible.
+func (s *VectorService) storeChunks(tx *sql.Tx, documentID int64, title string, chunks *embeddedChunks) (int, error) {
+	stored := 0
+	for i, chunk := range chunks.texts {
+		if len(chunks.embeddings[i]) != len(chunks.embeddings[0]) {
+			return 0, fmt.Errorf("chunk %d has %d instead of %d embedding dimensions", i+1, len(chunks.embeddings[i]), len(chunks.embeddings[0]))
+		}
+		var known bool
+		if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM vectors WHERE content_hash=?)", chunks.hashes[i]).Scan(&known); err != nil {
+			return 0, fmt.Errorf("failed to look up chunk %d: %w", i+1, err)
+		}
+		if known {
+			chunks.skipped = append(chunks.skipped, chunks.hashes[i])
+			chunks.duplicates++
+			continue
+		}
+		if err := s.storeChunk(tx, documentID, title, chunk, chunks.hashes[i], chunks.embeddings[i]); err != nil {
+			return 0, fmt.Errorf("failed to store chunk %d: %w", i+1, err)
+		}
+		stored++
+	}
+	if err := recordSkippedChunks(tx, documentID, chunks.skipped); err != nil {
+		return 0, err
+	}
+	return stored, nil
+}
+
+// ListDocuments returns all documents with their number of chunks, newest first. The content is not loaded.
+func (s *VectorService) ListDocuments() ([]Document, error) {
+	rows, err := s.db.Query(`SELECT d.id, d.name, d.source, d.content_hash, d.chunk_strategy, d.chunk_size, d.chunk_overlap, d.created_at,
+			(SELECT COUNT(*) FROM vectors v WHERE v.document_id = d.id)
+		FROM documents d
+		ORDER BY d.id DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list documents: %w", err)
+	}
+	defer rows.Close()
+
+	var documents []Document
+	for rows.Next() {
+		var document Document
+		err := rows.Scan(&document.ID, &document.Name, &document.Source, &document.ContentHash, &document.ChunkStrategy,
+			&document.ChunkSize, &document.ChunkOverlap, &document.CreatedAt, &document.ChunkCount)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan document: %w", err)
+		}
+		documents = append(documents, document)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list documents: %w", err)
+	}
+	return documents, nil
+}
+
+// GetDocument returns a single document including its content.
+func (s *VectorService) GetDocument(id int64) (*Document, error) {
+	var document Document
+	err := s.db.QueryRow(`SELECT d.id, d.name, d.source, d.content_hash, d.content, d.chunk_strategy, d.chunk_size, d.chunk_overlap, d.created_at,
+			(SELECT COUNT(*) FROM vectors v WHERE v.document_id = d.id)
+		FROM documents d
+		WHERE d.id=?`, id).Scan(&document.ID, &document.Name, &document.Source, &document.ContentHash, &document.Content,
+		&document.ChunkStrategy, &document.ChunkSize, &document.ChunkOverlap, &document.CreatedAt, &document.ChunkCount)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("document %d not found", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get document: %w", err)
+	}
+	return &document, nil
+}
+
+// GetDocumentChunks returns the chunks of a document in the order they were stored.
+func (s *VectorService) GetDocumentChunks(id int64) ([]VectorItem, error) {
+	ids, texts, err := s.listChunksWhere("document_id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]VectorItem, len(ids))
+	for i := range ids {
+		items[i] = VectorItem{ID: ids[i], Text: texts[i]}
+	}
+	return items, nil
+}
+
+// DeleteDocument deletes a document together with all of its chunks.
+func (s *VectorService) DeleteDocument(id int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := deleteDocumentChunks(tx, id); err != nil {
+		return fmt.Errorf("failed to delete chunks: %w", err)
+	}
+	result, err := tx.Exec("DELETE FROM documents WHERE id=?", id)
+	if err != nil {
+		return fmt.Errorf("failed to delete document: %w", err)
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return fmt.Errorf("document %d not found", id)
+	}
+	return tx.Commit()
+}
+
+// deleteDocumentChunks deletes the chunks of a document from the vectors table and the full-text index. Chunks
+// other documents skipped because this one stores their text are handed over to them instead, so their text
+// stays searchable.
+func deleteDocumentChunks(executor sqlExecutor, documentID int64) error {
+	if err := handOverSkippedChunks(executor, documentID); err != nil {
+		return err
+	}
+	_, err := executor.Exec("DELETE FROM vectors_fts WHERE rowid IN (SELECT id FROM vectors WHERE document_id=?)", documentID)
+	if err != nil {
+		return err
+	}
+	_, err = executor.Exec("DELETE FROM vectors WHERE document_id=?", documentID)
+	if err != nil {
+		return err
+	}
+	_, err = executor.Exec("DELETE FROM skipped_chunks WHERE document_id=?", documentID)
+	return err
+}
+
+// hashContent returns the hex encoded SHA-256 hash of a text.
+func hashContent(text string) string {
+	hash := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(hash[:])
+}
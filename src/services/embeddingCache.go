@@ -0,0 +1,229 @@
+package services
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EmbeddingCache keeps embeddings of recently embedded texts in the database, keyed by embedding model and
+// text hash, so identical texts, e.g. unchanged chunks of a re-indexed document or a repeated question, are not
+// embedded again. Once it holds more than its limit, the least recently used embeddings are evicted.
+// A nil cache or a limit of 0 caches nothing.
+type EmbeddingCache struct {
+	mu            sync.Mutex
+	limit         int
+	hits          atomic.Int64
+	misses        atomic.Int64
+	vectorService *VectorService
+}
+
+// EmbeddingCacheStats describes the usage of the cache. Hits and misses are counted since the start.
+type EmbeddingCacheStats struct {
+	Entries int
+	Limit   int
+	Hits    int64
+	Misses  int64
+}
+
+// HitRate returns the share of texts found in the cache in percent.
+func (s EmbeddingCacheStats) HitRate() int {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return int(s.Hits * 100 / (s.Hits + s.Misses))
+}
+
+func (s *VectorService) createEmbeddingCacheTable() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS embedding_cache (
+		model TEXT NOT NULL,
+		hash TEXT NOT NULL,
+		embedding BLOB NOT NULL,
+		last_used INTEGER NOT NULL,
+		PRIMARY KEY (model, hash)
+	) STRICT`)
+	if err != nil {
+		return fmt.Errorf("failed to create embedding cache table: %w", err)
+	}
+
+	_, err = s.db.Exec("CREATE INDEX IF NOT EXISTS embedding_cache_last_used_idx ON embedding_cache (last_used)")
+	if err != nil {
+		return fmt.Errorf("failed to create embedding cache index: %w", err)
+	}
+	return nil
+}
+
+// SetUpEmbeddingCache creates a cache holding at most limit embeddings.
+func SetUpEmbeddingCache(vectorService *VectorService, limit int) *EmbeddingCache {
+	cache := &EmbeddingCache{vectorService: vectorService}
+	cache.SetLimit(limit)
+	return cache
+}
+
+// SetLimit changes the maximum number of cached embeddings and evicts the ones beyond it.
+func (c *EmbeddingCache) SetLimit(limit int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.limit = max(limit, 0)
+	if err := c.evict(); err != nil {
+		log.Printf("Failed to evict cached embeddings: %v\n", err)
+	}
+}
+
+// Stats returns the number of cached embeddings and the hits and misses since the start.
+func (c *EmbeddingCache) Stats() (EmbeddingCacheStats, error) {
+	c.mu.Lock()
+	limit := c.limit
+	c.mu.Unlock()
+
+	stats := EmbeddingCacheStats{Limit: limit, Hits: c.hits.Load(), Misses: c.misses.Load()}
+	err := c.vectorService.db.QueryRow("SELECT COUNT(*) FROM embedding_cache").Scan(&stats.Entries)
+	if err != nil {
+		return stats, fmt.Errorf("failed to count cached embeddings: %w", err)
+	}
+	return stats, nil
+}
+
+// lookup returns the cached embeddings of the texts, with nil for every text that is not cached.
+func (c *EmbeddingCache) lookup(model string, texts []string) ([][]float32, error) {
+	embeddings := make([][]float32, len(texts))
+	if !c.enabled() {
+		return embeddings, nil
+	}
+
+	model = normalizeModelName(model)
+	indices := make(map[string][]int, len(texts)) // Hash to the positions of texts with that hash
+	hashes := make([]string, 0, len(texts))
+	for i, text := range texts {
+		hash := hashContent(text)
+		if _, ok := indices[hash]; !ok {
+			hashes = append(hashes, hash)
+		}
+		indices[hash] = append(indices[hash], i)
+	}
+
+	db := c.vectorService.db
+	now := time.Now().UnixNano()
+	for start := 0; start < len(hashes); start += hashLookupSize {
+		batch := hashes[start:min(start+hashLookupSize, len(hashes))]
+		args := make([]any, 0, len(batch)+1)
+		args = append(args, model)
+		for _, hash := range batch {
+			args = append(args, hash)
+		}
+		placeholders := "?" + strings.Repeat(", ?", len(batch)-1)
+
+		rows, err := db.Query("SELECT hash, embedding FROM embedding_cache WHERE model=? AND hash IN ("+placeholders+")", args...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up cached embeddings: %w", err)
+		}
+		for rows.Next() {
+			var (
+				hash string
+				blob []byte
+			)
+			if err := rows.Scan(&hash, &blob); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan cached embedding: %w", err)
+			}
+			embedding := decodeEmbedding(blob)
+			for _, i := range indices[hash] {
+				embeddings[i] = embedding
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up cached embeddings: %w", err)
+		}
+
+		// Mark the hits as recently used, so they are evicted last
+		_, err = db.Exec("UPDATE embedding_cache SET last_used=? WHERE model=? AND hash IN ("+placeholders+")",
+			append([]any{now}, args...)...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update cached embeddings: %w", err)
+		}
+	}
+
+	var hits int64
+	for _, embedding := range embeddings {
+		if embedding != nil {
+			hits++
+		}
+	}
+	c.hits.Add(hits)
+	c.misses.Add(int64(len(texts)) - hits)
+	return embeddings, nil
+}
+
+// store caches the embeddings of the texts and evicts the least recently used ones beyond the limit.
+func (c *EmbeddingCache) store(model string, texts []string, embeddings [][]float32) error {
+	if !c.enabled() {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tx, err := c.vectorService.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	model = normalizeModelName(model)
+	now := time.Now().UnixNano()
+	for i, text := range texts {
+		_, err := tx.Exec("INSERT OR REPLACE INTO embedding_cache (model, hash, embedding, last_used) VALUES (?, ?, ?, ?)",
+			model, hashContent(text), encodeEmbedding(embeddings[i]), now)
+		if err != nil {
+			return fmt.Errorf("failed to cache embedding: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to cache embeddings: %w", err)
+	}
+	return c.evict()
+}
+
+// evict deletes the least recently used embeddings beyond the limit. The caller must hold c.mu.
+func (c *EmbeddingCache) evict() error {
+	_, err := c.vectorService.db.Exec(`DELETE FROM embedding_cache WHERE rowid IN (
+		SELECT rowid FROM embedding_cache ORDER BY last_used DESC LIMIT -1 OFFSET ?)`, c.limit)
+	if err != nil {
+		return fmt.Errorf("failed to evict cached embeddings: %w", err)
+	}
+	return nil
+}
+
+func (c *EmbeddingCache) enabled() bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.limit > 0
+}
+
+// encodeEmbedding stores an embedding as little-endian float32 values, like F32_BLOB.
+func encodeEmbedding(embedding []float32) []byte {
+	blob := make([]byte, 4*len(embedding))
+	for i, value := range embedding {
+		binary.LittleEndian.PutUint32(blob[4*i:], math.Float32bits(value))
+	}
+	return blob
+}
+
+func decodeEmbedding(blob []byte) []float32 {
+	embedding := make([]float32, len(blob)/4)
+	for i := range embedding {
+		embedding[i] = math.Float32frombits(binary.LittleEndian.Uint32(blob[4*i:]))
+	}
+	return embedding
+}
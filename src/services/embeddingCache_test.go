@@ -0,0 +1,170 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// cachedTexts returns which of the texts the cache holds an embedding for.
+func cachedTexts(t *testing.T, cache *EmbeddingCache, texts ...string) []string {
+	t.Helper()
+	embeddings, err := cache.lookup("test-embedding", texts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cached []string
+	for i, embedding := range embeddings {
+		if embedding != nil {
+			cached = append(cached, texts[i])
+		}
+	}
+	return cached
+}
+
+func TestEmbeddingCache(t *testing.T) {
+	store := func(cache *EmbeddingCache, text string) {
+		if err := cache.store("test-embedding", []string{text}, [][]float32{{float32(len(text)), 1}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		limit      int
+		use        func(cache *EmbeddingCache)
+		want       []string // Of one, two and three
+		wantHits   int64    // Before looking up want
+		wantMisses int64
+	}{
+		{
+			name:  "below the limit",
+			limit: 3,
+			use: func(cache *EmbeddingCache) {
+				store(cache, "one")
+				store(cache, "two")
+			},
+			want: []string{"one", "two"},
+		},
+		{
+			name:  "least recently stored evicted",
+			limit: 2,
+			use: func(cache *EmbeddingCache) {
+				store(cache, "one")
+				store(cache, "two")
+				store(cache, "three")
+			},
+			want: []string{"two", "three"},
+		},
+		{
+			name:  "least recently used evicted",
+			limit: 2,
+			use: func(cache *EmbeddingCache) {
+				store(cache, "one")
+				store(cache, "two")
+				cachedTexts(t, cache, "one", "four")
+				store(cache, "three")
+			},
+			want:       []string{"one", "three"},
+			wantHits:   1,
+			wantMisses: 1,
+		},
+		{
+			name:  "limit lowered",
+			limit: 3,
+			use: func(cache *EmbeddingCache) {
+				store(cache, "one")
+				store(cache, "two")
+				store(cache, "three")
+				cache.SetLimit(1)
+			},
+			want: []string{"three"},
+		},
+		{
+			name:  "disabled",
+			limit: 3,
+			use: func(cache *EmbeddingCache) {
+				store(cache, "one")
+				cache.SetLimit(0)
+				store(cache, "two")
+				cachedTexts(t, cache, "one", "two")
+				cache.SetLimit(3)
+			},
+			want: nil,
+		},
+		{
+			name:  "model names normalized",
+			limit: 3,
+			use: func(cache *EmbeddingCache) {
+				if err := cache.store("test-embedding:latest", []string{"one"}, [][]float32{{3, 1}}); err != nil {
+					t.Fatal(err)
+				}
+				if err := cache.store("other-embedding", []string{"two"}, [][]float32{{3, 1}}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: []string{"one"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache := SetUpEmbeddingCache(newTestVectorService(t), test.limit)
+			test.use(cache)
+
+			stats, err := cache.Stats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Hits != test.wantHits || stats.Misses != test.wantMisses {
+				t.Errorf("%d hits and %d misses, want %d and %d", stats.Hits, stats.Misses, test.wantHits, test.wantMisses)
+			}
+			if got := cachedTexts(t, cache, "one", "two", "three"); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("cached %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEmbedBatchCached(t *testing.T) {
+	s := newTestVectorService(t)
+	ollamaService, backend := fakeOllamaEmbedBackend(t)
+	cache := SetUpEmbeddingCache(s, 10)
+	ollamaService.SetEmbeddingCache(cache)
+
+	first, err := ollamaService.EmbedBatch(context.Background(), []string{"one", "two"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.requestsTo("/api/embed")
+
+	var progress []int
+	second, err := ollamaService.EmbedBatch(context.Background(), []string{"two", "three", "one", "two"},
+		func(done int) { progress = append(progress, done) })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(second[0], first[1]) || !reflect.DeepEqual(second[2], first[0]) || !reflect.DeepEqual(second[3], first[1]) {
+		t.Errorf("cached embeddings %v, want the ones of the first texts %v", second, first)
+	}
+	requests := backend.requestsTo("/api/embed")
+	var embed EmbeddingRequest
+	if len(requests) == 1 {
+		json.Unmarshal([]byte(requests[0].Body), &embed)
+	}
+	if !reflect.DeepEqual(embed.Input, []string{"three"}) {
+		t.Errorf("requests %+v, want only the new text embedded", requests)
+	}
+	if want := []int{3, 4}; !reflect.DeepEqual(progress, want) {
+		t.Errorf("progress %v, want %v", progress, want)
+	}
+	stats, err := cache.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (EmbeddingCacheStats{Entries: 3, Limit: 10, Hits: 3, Misses: 3}); stats != want {
+		t.Errorf("stats = %+v, want %+v", stats, want)
+	}
+}
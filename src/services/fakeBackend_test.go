@@ -0,0 +1,155 @@
+package services
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBackend is a fake LLM backend answering requests by path and recording them. Paths without a
+// response are answered with 404.
+type fakeBackend struct {
+	*httptest.Server
+	responses map[string]fakeResponse
+	delay     time.Duration // Added before every response, set it before sending requests
+
+	mu       sync.Mutex
+	requests []fakeRequest
+}
+
+// fakeResponse returns the body answering a request. "\n\n" separated parts of the body are flushed one by
+// one, like a streamed answer.
+type fakeResponse func(request fakeRequest) string
+
+type fakeRequest struct {
+	Method        string
+	Path          string
+	Authorization string
+	Body          string
+}
+
+// fixedResponse answers every request with the same body.
+func fixedResponse(body string) fakeResponse {
+	return func(request fakeRequest) string { return body }
+}
+
+func newFakeBackend(t *testing.T, responses map[string]fakeResponse) *fakeBackend {
+	t.Helper()
+	backend := &fakeBackend{responses: responses}
+	backend.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		request := fakeRequest{Method: r.Method, Path: r.URL.Path, Authorization: r.Header.Get("Authorization"), Body: string(body)}
+		backend.mu.Lock()
+		backend.requests = append(backend.requests, request)
+		backend.mu.Unlock()
+
+		select {
+		case <-time.After(backend.delay):
+		case <-r.Context().Done():
+			return
+		}
+		response, ok := backend.responses[r.URL.Path]
+		if !ok {
+			http.Error(w, `{"error":"not found"}`, http.StatusNotFound)
+			return
+		}
+		for _, part := range strings.SplitAfter(response(request), "\n\n") {
+			w.Write([]byte(part))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+// requestsTo returns the requests received for a path, all of them for an empty path, and forgets them.
+func (b *fakeBackend) requestsTo(path string) []fakeRequest {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var requests, kept []fakeRequest
+	for _, request := range b.requests {
+		if path == "" || request.Path == path {
+			requests = append(requests, request)
+		} else {
+			kept = append(kept, request)
+		}
+	}
+	b.requests = kept
+	return requests
+}
+
+// lastRequest returns the only request the backend received.
+func (b *fakeBackend) lastRequest(t *testing.T) fakeRequest {
+	t.Helper()
+	requests := b.requestsTo("")
+	if len(requests) != 1 {
+		t.Fatalf("backend received %d requests, want 1: %+v", len(requests), requests)
+	}
+	return requests[0]
+}
+
+// fakeEmbeddings answers Ollama's /api/embed with a 3-dimensional embedding per input.
+func fakeEmbeddings(request fakeRequest) string {
+	var embed EmbeddingRequest
+	json.Unmarshal([]byte(request.Body), &embed)
+	response := EmbeddingResponse{Model: embed.Model}
+	for i, input := range embed.Input {
+		response.Embeddings = append(response.Embeddings, []float32{float32(len(input)), float32(i), 1})
+	}
+	body, _ := json.Marshal(response)
+	return string(body)
+}
+
+// fakeOllamaEmbed creates a service talking to a fake Ollama embedding texts with fakeEmbeddings.
+func fakeOllamaEmbed(t *testing.T) *OllamaService {
+	t.Helper()
+	service, _ := fakeOllamaEmbedBackend(t)
+	return service
+}
+
+// fakeOllamaEmbedBackend works like fakeOllamaEmbed, but also returns the fake Ollama, e.g. to delay it.
+func fakeOllamaEmbedBackend(t *testing.T) (*OllamaService, *fakeBackend) {
+	t.Helper()
+	backend := newFakeBackend(t, map[string]fakeResponse{"/api/embed": fakeEmbeddings})
+	service, err := SetUpOllamaService(Settings{Provider: ProviderOllama, URL: backend.URL, LLM: "test-llm", Embedding: "test-embedding"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return service, backend
+}
+
+// ollamaModels answers Ollama's /api/tags and /api/show with the given models and their capabilities.
+func ollamaModels(capabilities map[string][]string) map[string]fakeResponse {
+	return map[string]fakeResponse{
+		"/api/tags": func(request fakeRequest) string {
+			var tags TagsResponse
+			for name := range capabilities {
+				tags.Models = append(tags.Models, Model{Name: name, Model: name})
+			}
+			body, _ := json.Marshal(tags)
+			return string(body)
+		},
+		"/api/show": func(request fakeRequest) string {
+			var show ShowRequest
+			json.Unmarshal([]byte(request.Body), &show)
+			body, _ := json.Marshal(ShowResponse{Capabilities: capabilities[show.Model]})
+			return string(body)
+		},
+	}
+}
+
+// modelsShown returns the models the backend was asked to show since the last call.
+func (b *fakeBackend) modelsShown() []string {
+	var shown []string
+	for _, request := range b.requestsTo("/api/show") {
+		var show ShowRequest
+		json.Unmarshal([]byte(request.Body), &show)
+		shown = append(shown, show.Model)
+	}
+	return shown
+}
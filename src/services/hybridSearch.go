@@ -0,0 +1,152 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// RetrievalMode selects how SearchChunks finds the context of a question.
+type RetrievalMode string
+
+const (
+	// RetrievalVector ranks chunks by the cosine distance of their embeddings to the question.
+	RetrievalVector RetrievalMode = "vector"
+	// RetrievalHybrid fuses the vector ranking with a BM25 keyword ranking, so exact terms like
+	// error codes or product numbers are found even if their embeddings are not close to the question.
+	RetrievalHybrid RetrievalMode = "hybrid"
+)
+
+// rrfK dampens the influence of the top ranks in reciprocal rank fusion, 60 is the value from the original paper.
+const rrfK = 60
+
+// hybridCandidates is the minimum number of candidates taken from each ranking before fusing them.
+const hybridCandidates = 20
+
+// createFullTextTable creates the FTS5 table mirroring the text of the vectors table, using the chunk id as rowid.
+// Chunks stored before the table existed are indexed right away.
+func (s *VectorService) createFullTextTable() error {
+	_, err := s.db.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS vectors_fts USING fts5(text)")
+	if err != nil {
+		return fmt.Errorf("failed to create full-text table: %w", err)
+	}
+
+	var chunkCount, indexedCount int
+	err = s.db.QueryRow("SELECT (SELECT COUNT(*) FROM vectors), (SELECT COUNT(*) FROM vectors_fts)").Scan(&chunkCount, &indexedCount)
+	if err != nil {
+		return fmt.Errorf("failed to count indexed chunks: %w", err)
+	}
+	if chunkCount == indexedCount {
+		return nil
+	}
+
+	log.Printf("Rebuilding full-text index of %d chunks\n", chunkCount)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM vectors_fts"); err != nil {
+		return fmt.Errorf("failed to clear full-text index: %w", err)
+	}
+	if _, err := tx.Exec("INSERT INTO vectors_fts (rowid, text) SELECT id, text FROM vectors"); err != nil {
+		return fmt.Errorf("failed to rebuild full-text index: %w", err)
+	}
+	return tx.Commit()
+}
+
+// SearchChunks finds the chunks most relevant to a question, using the retrieval mode of the options.
+func (s *VectorService) SearchChunks(question string, queryEmbedding []float32, options RetrievalOptions) ([]VectorItem, error) {
+	if options.Mode != RetrievalHybrid {
+		return s.FindSimilarVectors(queryEmbedding, options)
+	}
+
+	// Take more candidates than needed from both rankings, so chunks ranked well by both can move up
+	candidates := options
+	candidates.TopK = max(options.TopK*4, hybridCandidates)
+
+	vectorItems, err := s.FindSimilarVectors(queryEmbedding, candidates)
+	if err != nil {
+		return nil, err
+	}
+	keywordItems, err := s.findKeywordMatches(question, queryEmbedding, candidates)
+	if err != nil {
+		return nil, err
+	}
+
+	return fuseRankings(options.TopK, vectorItems, keywordItems), nil
+}
+
+// findKeywordMatches ranks the chunks containing any word of the question by BM25, leaving out those further
+// away from the query embedding than options.MaxDistance like the vector ranking does. Otherwise a common word
+// would bring in unrelated chunks the threshold is meant to keep out of the context.
+func (s *VectorService) findKeywordMatches(question string, queryEmbedding []float32, options RetrievalOptions) ([]VectorItem, error) {
+	query := fullTextQuery(question)
+	if query == "" {
+		return nil, nil
+	}
+
+	vectorStr := vectorString(queryEmbedding)
+	rows, err := s.db.Query(
+		`SELECT v.id, COALESCE(v.document_id, 0), v.title, v.text, vector_extract(v.embedding),
+       vector_distance_cos(v.embedding, vector32(?))
+		FROM vectors_fts f
+		JOIN vectors v ON v.id = f.rowid
+		WHERE vectors_fts MATCH ? AND vector_distance_cos(v.embedding, vector32(?)) <= ?
+		ORDER BY f.rank
+		LIMIT ?;`, vectorStr, query, vectorStr, options.MaxDistance, options.TopK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search chunks by keyword: %w", err)
+	}
+	return scanSimilarVectors(rows)
+}
+
+var fullTextTermRegex = regexp.MustCompile(`[\p{L}\p{N}_]+(?:[-.:/][\p{L}\p{N}_]+)*`)
+
+// fullTextQuery turns a question into an FTS5 query matching any of its terms. Every term is quoted, so
+// characters with a meaning in the FTS5 query syntax cannot break the query.
+func fullTextQuery(question string) string {
+	seen := make(map[string]bool)
+	var terms []string
+	for _, term := range fullTextTermRegex.FindAllString(strings.ToLower(question), -1) {
+		if seen[term] {
+			continue
+		}
+		seen[term] = true
+		terms = append(terms, `"`+term+`"`)
+	}
+	return strings.Join(terms, " OR ")
+}
+
+// fuseRankings combines rankings with reciprocal rank fusion: every chunk scores 1/(rrfK + rank) for each
+// ranking it appears in, and the topK chunks with the highest total score are returned.
+func fuseRankings(topK int, rankings ...[]VectorItem) []VectorItem {
+	scores := make(map[int64]float64)
+	items := make(map[int64]VectorItem)
+	var order []int64
+	for _, ranking := range rankings {
+		for rank, item := range ranking {
+			if _, ok := items[item.ID]; !ok {
+				items[item.ID] = item
+				order = append(order, item.ID)
+			}
+			scores[item.ID] += 1 / float64(rrfK+rank+1)
+		}
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		return scores[order[i]] > scores[order[j]]
+	})
+	if len(order) > topK {
+		order = order[:topK]
+	}
+
+	fused := make([]VectorItem, len(order))
+	for i, id := range order {
+		fused[i] = items[id]
+	}
+	return fused
+}
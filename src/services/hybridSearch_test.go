@@ -0,0 +1,52 @@
+package services
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSearchChunksHybridMaxDistance(t *testing.T) {
+	s := newTestVectorService(t)
+	documentID := insertTestDocument(t, s)
+
+	chunks := []struct {
+		text      string
+		embedding []float32
+	}{
+		{text: "Error E1234 stops the pump", embedding: []float32{1, 0, 0}},
+		{text: "Priming the pump", embedding: []float32{0.9, 0.1, 0}},
+		{text: "A pump for the garden pond", embedding: []float32{0, 0, 1}},
+	}
+	for _, chunk := range chunks {
+		if err := s.StoreChunkAndEmbedding(documentID, "Manual", chunk.text, chunk.embedding, "model"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		maxDistance float64
+		want        []string
+	}{
+		{name: "keyword match beyond the maximum distance", maxDistance: 0.5,
+			want: []string{"Error E1234 stops the pump", "Priming the pump"}},
+		{name: "no maximum distance", maxDistance: 2,
+			want: []string{"Error E1234 stops the pump", "Priming the pump", "A pump for the garden pond"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := RetrievalOptions{TopK: 5, MaxDistance: test.maxDistance, Mode: RetrievalHybrid}
+			items, err := s.SearchChunks("Why does the pump show E1234?", []float32{1, 0, 0}, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, item := range items {
+				got = append(got, item.Text)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("chunks = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
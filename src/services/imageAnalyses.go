@@ -0,0 +1,211 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// maxListedImageAnalyses limits the number of analyses shown in the gallery.
+const maxListedImageAnalyses = 50
+
+// ImageAnalysis is an answer of the vision model about an uploaded image. It is kept, together with a
+// thumbnail of the image, after the upload itself is gone. Like the upload, it is only shown to the browser
+// session that asked about the image.
+type ImageAnalysis struct {
+	ID           int64
+	ImageID      string
+	SessionID    string
+	Filename     string
+	Annotations  ImageMetadata
+	Question     string
+	Model        string
+	Answer       string
+	HasThumbnail bool
+	JobID        int64     // Job adding the analysis to the vector database, 0 if it wasn't added
+	JobStatus    JobStatus // Status of that job
+	DocumentID   int64     // Document the job created, 0 if it didn't finish or the document was deleted
+	CreatedAt    string
+}
+
+// InKnowledgeBase reports whether the analysis was added to the vector database.
+func (a *ImageAnalysis) InKnowledgeBase() bool {
+	return a.JobStatus == JobDone && a.DocumentID != 0
+}
+
+// DocumentName returns the name of the document the analysis is stored as in the vector database.
+func (a *ImageAnalysis) DocumentName() string {
+	return fmt.Sprintf("Image analysis #%d: %s", a.ID, a.Filename)
+}
+
+// DocumentText returns the text the analysis is stored as in the vector database, so later questions can
+// find what was seen in the image.
+func (a *ImageAnalysis) DocumentText() string {
+	var text strings.Builder
+	fmt.Fprintf(&text, "Analysis of the image %s by %s on %s.\n\n", a.Filename, a.Model, a.CreatedAt)
+	fmt.Fprintf(&text, "Question: %s\n\n", a.Question)
+	fmt.Fprintf(&text, "Answer: %s\n", a.Answer)
+	return text.String()
+}
+
+func (s *VectorService) createImageAnalysesTable() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS image_analyses (
+		id INTEGER PRIMARY KEY,
+		image_id TEXT NOT NULL,
+		session_id TEXT NOT NULL DEFAULT '',
+		filename TEXT NOT NULL,
+		annotations TEXT NOT NULL,
+		question TEXT NOT NULL,
+		model TEXT NOT NULL,
+		answer TEXT NOT NULL,
+		thumbnail BLOB,
+		job_id INTEGER REFERENCES jobs(id) ON DELETE SET NULL,
+		created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+	) STRICT`)
+	if err != nil {
+		return fmt.Errorf("failed to create image analyses table: %w", err)
+	}
+	// Analyses stored before they were kept per session get an empty session, which no browser has
+	if err := s.addColumnIfMissing("image_analyses", "session_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec("CREATE INDEX IF NOT EXISTS image_analyses_image_idx ON image_analyses (image_id)")
+	if err != nil {
+		return fmt.Errorf("failed to create image analyses index: %w", err)
+	}
+	_, err = s.db.Exec("CREATE INDEX IF NOT EXISTS image_analyses_session_idx ON image_analyses (session_id, id)")
+	if err != nil {
+		return fmt.Errorf("failed to create image analyses index: %w", err)
+	}
+	return nil
+}
+
+// CreateImageAnalysis stores an analysis with the thumbnail of its image, which may be nil.
+func (s *VectorService) CreateImageAnalysis(analysis *ImageAnalysis, thumbnail []byte) error {
+	annotations, err := json.Marshal(analysis.Annotations)
+	if err != nil {
+		return fmt.Errorf("failed to encode annotations: %w", err)
+	}
+	var thumbnailValue any // The driver stores a nil slice as empty blob instead of NULL
+	if thumbnail != nil {
+		thumbnailValue = thumbnail
+	}
+
+	err = s.db.QueryRow(`INSERT INTO image_analyses (image_id, session_id, filename, annotations, question, model, answer, thumbnail)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?) RETURNING id, created_at`,
+		analysis.ImageID, analysis.SessionID, analysis.Filename, string(annotations), analysis.Question, analysis.Model, analysis.Answer, thumbnailValue,
+	).Scan(&analysis.ID, &analysis.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to store image analysis: %w", err)
+	}
+	return nil
+}
+
+// ListImageAnalyses returns the most recent analyses of a session, newest first. A non-empty query only
+// returns analyses whose filename, question or answer contain it.
+func (s *VectorService) ListImageAnalyses(sessionID string, query string) ([]ImageAnalysis, error) {
+	if sessionID == "" {
+		return nil, nil
+	}
+	pattern := "%" + escapeLike(strings.TrimSpace(query)) + "%"
+	rows, err := s.db.Query(`SELECT a.id, a.image_id, a.session_id, a.filename, a.annotations, a.question, a.model,
+			a.answer, a.thumbnail IS NOT NULL, a.job_id, j.status, j.document_id, a.created_at
+		FROM image_analyses a LEFT JOIN jobs j ON j.id = a.job_id
+		WHERE a.session_id = ?1
+			AND (a.filename LIKE ?2 ESCAPE '\' OR a.question LIKE ?2 ESCAPE '\' OR a.answer LIKE ?2 ESCAPE '\')
+		ORDER BY a.id DESC LIMIT ?3`, sessionID, pattern, maxListedImageAnalyses)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list image analyses: %w", err)
+	}
+	defer rows.Close()
+
+	var analyses []ImageAnalysis
+	for rows.Next() {
+		analysis, err := scanImageAnalysis(rows)
+		if err != nil {
+			return nil, err
+		}
+		analyses = append(analyses, *analysis)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list image analyses: %w", err)
+	}
+	return analyses, nil
+}
+
+// GetImageAnalysis returns a single analysis, if it belongs to the session.
+func (s *VectorService) GetImageAnalysis(sessionID string, id int64) (*ImageAnalysis, error) {
+	analysis, err := scanImageAnalysis(s.db.QueryRow(`SELECT a.id, a.image_id, a.session_id, a.filename, a.annotations,
+			a.question, a.model, a.answer, a.thumbnail IS NOT NULL, a.job_id, j.status, j.document_id, a.created_at
+		FROM image_analyses a LEFT JOIN jobs j ON j.id = a.job_id
+		WHERE a.id=? AND a.session_id=? AND a.session_id != ''`, id, sessionID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("image analysis %d not found", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return analysis, nil
+}
+
+// GetImageAnalysisThumbnail returns the JPEG thumbnail of the image of an analysis of the session, or nil if
+// it has none.
+func (s *VectorService) GetImageAnalysisThumbnail(sessionID string, id int64) ([]byte, error) {
+	var thumbnail []byte
+	err := s.db.QueryRow("SELECT thumbnail FROM image_analyses WHERE id=? AND session_id=? AND session_id != ''",
+		id, sessionID).Scan(&thumbnail)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("image analysis %d not found", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get thumbnail: %w", err)
+	}
+	return thumbnail, nil
+}
+
+// setImageAnalysisJob links an analysis to the job adding it to the vector database.
+func (s *VectorService) setImageAnalysisJob(id int64, jobID int64) error {
+	_, err := s.db.Exec("UPDATE image_analyses SET job_id=? WHERE id=?", jobID, id)
+	if err != nil {
+		return fmt.Errorf("failed to update image analysis: %w", err)
+	}
+	return nil
+}
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanImageAnalysis(row rowScanner) (*ImageAnalysis, error) {
+	var (
+		analysis    ImageAnalysis
+		annotations string
+		jobID       sql.NullInt64
+		jobStatus   sql.NullString
+		documentID  sql.NullInt64
+	)
+	err := row.Scan(&analysis.ID, &analysis.ImageID, &analysis.SessionID, &analysis.Filename, &annotations, &analysis.Question,
+		&analysis.Model, &analysis.Answer, &analysis.HasThumbnail, &jobID, &jobStatus, &documentID, &analysis.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan image analysis: %w", err)
+	}
+	if err := json.Unmarshal([]byte(annotations), &analysis.Annotations); err != nil {
+		return nil, fmt.Errorf("failed to decode annotations of image analysis %d: %w", analysis.ID, err)
+	}
+	analysis.JobID = jobID.Int64
+	analysis.JobStatus = JobStatus(jobStatus.String)
+	analysis.DocumentID = documentID.Int64
+	return &analysis, nil
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern, using backslash as escape character.
+func escapeLike(text string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(text)
+}
@@ -0,0 +1,66 @@
+package services
+
+import (
+	"testing"
+)
+
+func TestImageAnalysesPerSession(t *testing.T) {
+	s := newTestVectorService(t)
+
+	analyses := map[string]*ImageAnalysis{}
+	for _, session := range []string{"first", "second"} {
+		analysis := &ImageAnalysis{ImageID: "image", SessionID: session, Filename: session + ".png", Question: "What is this?"}
+		if err := s.CreateImageAnalysis(analysis, []byte("thumbnail of "+session)); err != nil {
+			t.Fatal(err)
+		}
+		analyses[session] = analysis
+	}
+	// An analysis stored before the analyses were kept per session
+	if _, err := s.db.Exec(`INSERT INTO image_analyses (image_id, filename, annotations, question, model, answer)
+		VALUES ('image', 'old.png', '{}', 'What is this?', '', '')`); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		session string
+		want    *ImageAnalysis
+	}{
+		{name: "first session", session: "first", want: analyses["first"]},
+		{name: "second session", session: "second", want: analyses["second"]},
+		{name: "unknown session", session: "third"},
+		{name: "no session", session: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			listed, err := s.ListImageAnalyses(test.session, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.want == nil {
+				if len(listed) != 0 {
+					t.Errorf("listed %d analyses, want none", len(listed))
+				}
+			} else if len(listed) != 1 || listed[0].ID != test.want.ID {
+				t.Errorf("listed %+v, want only analysis %d", listed, test.want.ID)
+			}
+
+			for _, other := range analyses {
+				analysis, err := s.GetImageAnalysis(test.session, other.ID)
+				thumbnail, thumbnailErr := s.GetImageAnalysisThumbnail(test.session, other.ID)
+				if other == test.want {
+					if err != nil || analysis.Filename != other.Filename {
+						t.Errorf("analysis %d = %+v (%v), want %s", other.ID, analysis, err, other.Filename)
+					}
+					if want := "thumbnail of " + test.session; thumbnailErr != nil || string(thumbnail) != want {
+						t.Errorf("thumbnail of analysis %d = %q (%v), want %q", other.ID, thumbnail, thumbnailErr, want)
+					}
+					continue
+				}
+				if err == nil || thumbnailErr == nil {
+					t.Errorf("analysis %d of session %s found", other.ID, other.SessionID)
+				}
+			}
+		})
+	}
+}
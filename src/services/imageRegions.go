@@ -0,0 +1,257 @@
+package services
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"log"
+	"math"
+	"os"
+	"strings"
+)
+
+// ImageMode is how the marked areas of an image are shown to the vision model.
+type ImageMode string
+
+const (
+	ImageModeCoordinates ImageMode = "coordinates" // The whole image, the areas only as coordinates in the question
+	ImageModeCrop        ImageMode = "crop"        // One cropped image per area, with some padding around it
+	ImageModeOutline     ImageMode = "outline"     // The whole image with the areas drawn in as rectangles
+)
+
+// ParseImageMode returns the image mode of a form value, defaulting to cropping.
+func ParseImageMode(value string) ImageMode {
+	switch mode := ImageMode(value); mode {
+	case ImageModeCoordinates, ImageModeOutline:
+		return mode
+	default:
+		return ImageModeCrop
+	}
+}
+
+// Prepared images are encoded as JPEG, which keeps photos much smaller than PNG.
+const preparedImageQuality = 90
+
+// outlineColor is the color areas are drawn in, matching the rectangles of the annotation UI.
+var outlineColor = color.RGBA{R: 255, A: 255}
+
+// maxAnnotationRegions limits the number of areas marked on an image.
+const maxAnnotationRegions = 20
+
+// canvasRect is a rectangle drawn in the annotation UI, in pixels of the image as displayed. Rectangles drawn
+// up or to the left have a negative width or height.
+type canvasRect struct {
+	X *float64 `json:"x"`
+	Y *float64 `json:"y"`
+	W *float64 `json:"w"`
+	H *float64 `json:"h"`
+}
+
+// parseAnnotations reads the rectangles drawn on an image displayed at the given size and converts them to
+// regions in pixels of the original image of the given size. Malformed annotation data and rectangles outside
+// of the image are rejected; rectangles without an area, e.g. from a click, are skipped.
+func parseAnnotations(annotationData string, displayWidth float64, displayHeight float64, width int, height int) (ImageMetadata, error) {
+	metadata := ImageMetadata{Width: width, Height: height, Regions: []Region{}}
+	if strings.TrimSpace(annotationData) == "" {
+		return metadata, nil
+	}
+
+	var rects []canvasRect
+	decoder := json.NewDecoder(strings.NewReader(annotationData))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&rects)
+	var typeError *json.UnmarshalTypeError
+	if errors.As(err, &typeError) {
+		return ImageMetadata{}, fmt.Errorf("malformed annotation data: expected a list of rectangles with x, y, w and h")
+	}
+	if err != nil {
+		return ImageMetadata{}, fmt.Errorf("malformed annotation data: %w", err)
+	}
+	if decoder.More() {
+		return ImageMetadata{}, fmt.Errorf("malformed annotation data: unexpected data after the rectangles")
+	}
+	if len(rects) > maxAnnotationRegions {
+		return ImageMetadata{}, fmt.Errorf("at most %d areas can be marked, but got %d", maxAnnotationRegions, len(rects))
+	}
+	if len(rects) > 0 && (displayWidth <= 0 || displayHeight <= 0) {
+		return ImageMetadata{}, fmt.Errorf("the displayed size of the image is missing")
+	}
+
+	scaleX, scaleY := float64(width)/displayWidth, float64(height)/displayHeight
+	for i, rect := range rects {
+		if rect.X == nil || rect.Y == nil || rect.W == nil || rect.H == nil {
+			return ImageMetadata{}, fmt.Errorf("malformed annotation data: area %d lacks x, y, w or h", i+1)
+		}
+
+		minX, maxX := *rect.X*scaleX, (*rect.X+*rect.W)*scaleX
+		minY, maxY := *rect.Y*scaleY, (*rect.Y+*rect.H)*scaleY
+		minX, maxX = min(minX, maxX), max(minX, maxX)
+		minY, maxY = min(minY, maxY), max(minY, maxY)
+
+		// Allow an overshoot of one displayed pixel, e.g. from rounding in the browser
+		if minX < -scaleX || minY < -scaleY || maxX > float64(width)+scaleX || maxY > float64(height)+scaleY {
+			return ImageMetadata{}, fmt.Errorf("area %d is outside of the %dx%d image", i+1, width, height)
+		}
+
+		region := Region{
+			Min: Point{X: clampPixel(minX, width), Y: clampPixel(minY, height)},
+			Max: Point{X: clampPixel(maxX, width), Y: clampPixel(maxY, height)},
+		}
+		if region.Rectangle().Empty() {
+			continue
+		}
+		metadata.Regions = append(metadata.Regions, region)
+	}
+	return metadata, nil
+}
+
+// clampPixel rounds a coordinate to the nearest pixel edge between 0 and size.
+func clampPixel(value float64, size int) int {
+	return min(max(int(math.Round(value)), 0), size)
+}
+
+// Rectangle returns the region as image rectangle.
+func (r Region) Rectangle() image.Rectangle {
+	return image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Max.Y)
+}
+
+// prepareImages returns the base64 encoded images to send for the marked areas of the image at imagePath,
+// together with the mode actually used. Without marked areas, or for images that can't be decoded, the whole
+// image is sent as it is.
+func prepareImages(imagePath string, annotations ImageMetadata, mode ImageMode) ([]string, ImageMode, error) {
+	data, err := os.ReadFile(imagePath)
+	if err != nil {
+		return nil, "", fmt.Errorf("error reading image file: %w", err)
+	}
+	original := []string{base64.StdEncoding.EncodeToString(data)}
+	if mode == ImageModeCoordinates || len(annotations.Regions) == 0 {
+		return original, ImageModeCoordinates, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		log.Printf("Sending %s whole, as it can't be decoded: %v\n", imagePath, err)
+		return original, ImageModeCoordinates, nil
+	}
+
+	var images []image.Image
+	switch mode {
+	case ImageModeCrop:
+		for _, region := range annotations.Regions {
+			images = append(images, cropArea(img, region.Rectangle()))
+		}
+	case ImageModeOutline:
+		images = append(images, outlineAreas(img, annotations.Regions))
+	}
+
+	encoded := make([]string, len(images))
+	for i, img := range images {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: preparedImageQuality}); err != nil {
+			return nil, "", fmt.Errorf("failed to encode image: %w", err)
+		}
+		encoded[i] = base64.StdEncoding.EncodeToString(buf.Bytes())
+	}
+	return encoded, mode, nil
+}
+
+// cropArea copies an area within the image, padded by a fifth of its size but at least 16 pixels on every side,
+// so the model sees some context.
+func cropArea(img image.Image, area image.Rectangle) image.Image {
+	padding := max(16, max(area.Dx(), area.Dy())/5)
+	area = area.Inset(-padding).Add(img.Bounds().Min).Intersect(img.Bounds())
+
+	crop := image.NewRGBA(image.Rect(0, 0, area.Dx(), area.Dy()))
+	draw.Draw(crop, crop.Bounds(), img, area.Min, draw.Src)
+	return crop
+}
+
+// outlineAreas copies the image and draws the areas into it as rectangles, with lines thick enough to be
+// seen on large images.
+func outlineAreas(img image.Image, regions []Region) image.Image {
+	bounds := img.Bounds()
+	outlined := image.NewRGBA(bounds)
+	draw.Draw(outlined, bounds, img, bounds.Min, draw.Src)
+
+	width := max(2, min(bounds.Dx(), bounds.Dy())/200)
+	fill := image.NewUniform(outlineColor)
+	for _, region := range regions {
+		area := region.Rectangle().Add(bounds.Min)
+		for _, line := range []image.Rectangle{
+			image.Rect(area.Min.X, area.Min.Y, area.Max.X, area.Min.Y+width), // Top
+			image.Rect(area.Min.X, area.Max.Y-width, area.Max.X, area.Max.Y), // Bottom
+			image.Rect(area.Min.X, area.Min.Y, area.Min.X+width, area.Max.Y), // Left
+			image.Rect(area.Max.X-width, area.Min.Y, area.Max.X, area.Max.Y), // Right
+		} {
+			draw.Draw(outlined, line.Intersect(bounds), fill, image.Point{}, draw.Src)
+		}
+	}
+	return outlined
+}
+
+// thumbnailSize is the maximum width and height of thumbnails.
+const thumbnailSize = 240
+
+// makeThumbnail returns a small JPEG of the image at imagePath with the marked areas drawn in, or nil for
+// images that can't be decoded.
+func makeThumbnail(imagePath string, annotations ImageMetadata) ([]byte, error) {
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening image file: %w", err)
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, nil
+	}
+
+	thumbnail := scaleDown(img, thumbnailSize)
+	scale := float64(thumbnail.Bounds().Dx()) / float64(img.Bounds().Dx())
+	regions := make([]Region, len(annotations.Regions))
+	for i, region := range annotations.Regions {
+		regions[i] = Region{
+			Min: Point{X: int(float64(region.Min.X) * scale), Y: int(float64(region.Min.Y) * scale)},
+			Max: Point{X: int(math.Ceil(float64(region.Max.X) * scale)), Y: int(math.Ceil(float64(region.Max.Y) * scale))},
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, outlineAreas(thumbnail, regions), &jpeg.Options{Quality: preparedImageQuality}); err != nil {
+		return nil, fmt.Errorf("failed to encode thumbnail: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// scaleDown shrinks the image to fit into a square of the given size, averaging the pixels each pixel of the
+// result covers. Smaller images are only copied.
+func scaleDown(img image.Image, size int) *image.RGBA {
+	bounds := img.Bounds()
+	factor := max(float64(bounds.Dx())/float64(size), float64(bounds.Dy())/float64(size), 1)
+	// Rounded, as the division may end just below the size, e.g. 1000/(1000/240)
+	width, height := int(math.Round(float64(bounds.Dx())/factor)), int(math.Round(float64(bounds.Dy())/factor))
+	scaled := image.NewRGBA(image.Rect(0, 0, max(1, width), max(1, height)))
+
+	for y := range scaled.Bounds().Dy() {
+		minY, maxY := bounds.Min.Y+int(float64(y)*factor), bounds.Min.Y+max(int(float64(y+1)*factor), int(float64(y)*factor)+1)
+		for x := range scaled.Bounds().Dx() {
+			minX, maxX := bounds.Min.X+int(float64(x)*factor), bounds.Min.X+max(int(float64(x+1)*factor), int(float64(x)*factor)+1)
+
+			var r, g, b, a, n uint64
+			for sy := minY; sy < min(maxY, bounds.Max.Y); sy++ {
+				for sx := minX; sx < min(maxX, bounds.Max.X); sx++ {
+					pr, pg, pb, pa := img.At(sx, sy).RGBA()
+					r, g, b, a, n = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa), n+1
+				}
+			}
+			scaled.SetRGBA(x, y, color.RGBA{R: uint8(r / n >> 8), G: uint8(g / n >> 8), B: uint8(b / n >> 8), A: uint8(a / n >> 8)})
+		}
+	}
+	return scaled
+}
@@ -0,0 +1,272 @@
+package services
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// coordinateImage returns an image whose pixels have their x coordinate as red and their y coordinate as
+// green value, so copies show where they were taken from.
+func coordinateImage(bounds image.Rectangle) *image.RGBA {
+	img := image.NewRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			img.SetRGBA(x, y, color.RGBA{R: uint8(x), G: uint8(y), A: 255})
+		}
+	}
+	return img
+}
+
+func TestCropArea(t *testing.T) {
+	tests := []struct {
+		name   string
+		bounds image.Rectangle
+		area   image.Rectangle
+		want   image.Rectangle // Within the image, relative to its origin
+	}{
+		{name: "small area padded by 16 pixels", bounds: image.Rect(0, 0, 100, 80), area: image.Rect(40, 30, 60, 50), want: image.Rect(24, 14, 76, 66)},
+		{name: "large area padded by a fifth", bounds: image.Rect(0, 0, 200, 200), area: image.Rect(50, 50, 150, 150), want: image.Rect(30, 30, 170, 170)},
+		{name: "padding cut at the top left", bounds: image.Rect(0, 0, 100, 80), area: image.Rect(0, 0, 10, 10), want: image.Rect(0, 0, 26, 26)},
+		{name: "padding cut at the bottom right", bounds: image.Rect(0, 0, 100, 80), area: image.Rect(90, 70, 100, 80), want: image.Rect(74, 54, 100, 80)},
+		{name: "whole image", bounds: image.Rect(0, 0, 100, 80), area: image.Rect(0, 0, 100, 80), want: image.Rect(0, 0, 100, 80)},
+		{name: "image not at the origin", bounds: image.Rect(10, 20, 110, 100), area: image.Rect(40, 30, 60, 50), want: image.Rect(24, 14, 76, 66)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			crop := cropArea(coordinateImage(test.bounds), test.area)
+			if size := crop.Bounds().Size(); size != test.want.Size() {
+				t.Fatalf("crop is %v, want %v", size, test.want.Size())
+			}
+			origin := test.want.Min.Add(test.bounds.Min)
+			if got, want := crop.At(crop.Bounds().Min.X, crop.Bounds().Min.Y), (color.RGBA{R: uint8(origin.X), G: uint8(origin.Y), A: 255}); got != want {
+				t.Errorf("top left pixel = %v, want %v of the image", got, want)
+			}
+		})
+	}
+}
+
+func TestOutlineAreas(t *testing.T) {
+	white := color.RGBA{R: 255, G: 255, B: 255, A: 255}
+	img := image.NewRGBA(image.Rect(0, 0, 50, 40))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+	regions := []Region{
+		{Min: Point{X: 10, Y: 10}, Max: Point{X: 30, Y: 20}},
+		{Min: Point{X: 40, Y: 30}, Max: Point{X: 50, Y: 40}}, // At the edge of the image
+	}
+
+	outlined := outlineAreas(img, regions)
+
+	tests := []struct {
+		name  string
+		point image.Point
+		want  color.Color
+	}{
+		{name: "top left corner", point: image.Pt(10, 10), want: outlineColor},
+		{name: "bottom right corner", point: image.Pt(29, 19), want: outlineColor},
+		{name: "second pixel of the left line", point: image.Pt(11, 15), want: outlineColor},
+		{name: "within the lines", point: image.Pt(12, 15), want: white},
+		{name: "middle of the area", point: image.Pt(20, 15), want: white},
+		{name: "outside of the areas", point: image.Pt(5, 5), want: white},
+		{name: "line at the edge of the image", point: image.Pt(49, 35), want: outlineColor},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := outlined.At(test.point.X, test.point.Y); got != test.want {
+				t.Errorf("pixel %v = %v, want %v", test.point, got, test.want)
+			}
+		})
+	}
+	if got := img.At(10, 10); got != white {
+		t.Errorf("original image changed to %v", got)
+	}
+}
+
+func TestPrepareImages(t *testing.T) {
+	var pngImage bytes.Buffer
+	if err := png.Encode(&pngImage, coordinateImage(image.Rect(0, 0, 100, 80))); err != nil {
+		t.Fatal(err)
+	}
+	regions := []Region{
+		{Min: Point{X: 40, Y: 30}, Max: Point{X: 60, Y: 50}},
+		{Min: Point{X: 0, Y: 0}, Max: Point{X: 10, Y: 10}},
+	}
+
+	tests := []struct {
+		name      string
+		data      []byte
+		regions   []Region
+		mode      ImageMode
+		wantMode  ImageMode
+		wantSizes []image.Point // Nil for the original file
+	}{
+		{name: "coordinates", data: pngImage.Bytes(), regions: regions, mode: ImageModeCoordinates, wantMode: ImageModeCoordinates},
+		{name: "crop without areas", data: pngImage.Bytes(), mode: ImageModeCrop, wantMode: ImageModeCoordinates},
+		{name: "outline without areas", data: pngImage.Bytes(), mode: ImageModeOutline, wantMode: ImageModeCoordinates},
+		{name: "crop", data: pngImage.Bytes(), regions: regions, mode: ImageModeCrop, wantMode: ImageModeCrop,
+			wantSizes: []image.Point{{X: 52, Y: 52}, {X: 26, Y: 26}}},
+		{name: "outline", data: pngImage.Bytes(), regions: regions, mode: ImageModeOutline, wantMode: ImageModeOutline,
+			wantSizes: []image.Point{{X: 100, Y: 80}}},
+		{name: "truncated file", data: pngImage.Bytes()[:pngImage.Len()/2], regions: regions, mode: ImageModeCrop, wantMode: ImageModeCoordinates},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "image.png")
+			if err := os.WriteFile(path, test.data, 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			images, mode, err := prepareImages(path, ImageMetadata{Width: 100, Height: 80, Regions: test.regions}, test.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mode != test.wantMode {
+				t.Errorf("mode = %s, want %s", mode, test.wantMode)
+			}
+			if test.wantSizes == nil {
+				if want := []string{base64.StdEncoding.EncodeToString(test.data)}; !reflect.DeepEqual(images, want) {
+					t.Errorf("got %d prepared images, want the original file", len(images))
+				}
+				return
+			}
+
+			var sizes []image.Point
+			for _, encoded := range images {
+				data, err := base64.StdEncoding.DecodeString(encoded)
+				if err != nil {
+					t.Fatal(err)
+				}
+				config, err := jpeg.DecodeConfig(bytes.NewReader(data))
+				if err != nil {
+					t.Fatalf("prepared image is no JPEG: %v", err)
+				}
+				sizes = append(sizes, image.Pt(config.Width, config.Height))
+			}
+			if !reflect.DeepEqual(sizes, test.wantSizes) {
+				t.Errorf("prepared images of %v, want %v", sizes, test.wantSizes)
+			}
+		})
+	}
+
+	if _, _, err := prepareImages(filepath.Join(t.TempDir(), "missing.png"), ImageMetadata{}, ImageModeCrop); err == nil {
+		t.Error("no error for a missing file")
+	}
+}
+
+func TestParseAnnotations(t *testing.T) {
+	tooMany := "[" + strings.Repeat(`{"x":1,"y":1,"w":1,"h":1},`, maxAnnotationRegions) + `{"x":1,"y":1,"w":1,"h":1}]`
+
+	// The 100x80 image is displayed at 50x40
+	tests := []struct {
+		name          string
+		data          string
+		noDisplaySize bool
+		want          []Region
+		wantErr       string
+	}{
+		{name: "no data", data: " ", want: []Region{}},
+		{name: "no rectangles", data: "[]", want: []Region{}},
+		{name: "scaled to the image", data: `[{"x":10,"y":5,"w":20,"h":10}]`,
+			want: []Region{{Min: Point{X: 20, Y: 10}, Max: Point{X: 60, Y: 30}}}},
+		{name: "drawn up and to the left", data: `[{"x":30,"y":15,"w":-20,"h":-10}]`,
+			want: []Region{{Min: Point{X: 20, Y: 10}, Max: Point{X: 60, Y: 30}}}},
+		{name: "rounded to pixels", data: `[{"x":10.2,"y":5.3,"w":0.5,"h":3}]`,
+			want: []Region{{Min: Point{X: 20, Y: 11}, Max: Point{X: 21, Y: 17}}}},
+		{name: "click without area skipped", data: `[{"x":10,"y":5,"w":0,"h":10},{"x":1,"y":1,"w":1,"h":1}]`,
+			want: []Region{{Min: Point{X: 2, Y: 2}, Max: Point{X: 4, Y: 4}}}},
+		{name: "overshoot of one displayed pixel", data: `[{"x":-1,"y":0,"w":52,"h":41}]`,
+			want: []Region{{Min: Point{X: 0, Y: 0}, Max: Point{X: 100, Y: 80}}}},
+		{name: "outside of the image", data: `[{"x":45,"y":5,"w":10,"h":10}]`, wantErr: "area 1 is outside of the 100x80 image"},
+		{name: "reversed outside of the image", data: `[{"x":5,"y":5,"w":-10,"h":10}]`, wantErr: "area 1 is outside"},
+		{name: "missing displayed size", data: `[{"x":1,"y":1,"w":1,"h":1}]`, noDisplaySize: true, wantErr: "displayed size"},
+		{name: "missing displayed size without rectangles", data: "[]", noDisplaySize: true, want: []Region{}},
+		{name: "unknown field", data: `[{"x":1,"y":1,"w":1,"h":1,"label":"cat"}]`, wantErr: `unknown field "label"`},
+		{name: "missing field", data: `[{"x":1,"y":1,"w":1}]`, wantErr: "area 1 lacks x, y, w or h"},
+		{name: "no list", data: `{"x":1,"y":1,"w":1,"h":1}`, wantErr: "expected a list of rectangles"},
+		{name: "text instead of a number", data: `[{"x":"1","y":1,"w":1,"h":1}]`, wantErr: "expected a list of rectangles"},
+		{name: "trailing data", data: `[{"x":1,"y":1,"w":1,"h":1}] []`, wantErr: "unexpected data after the rectangles"},
+		{name: "unterminated", data: `[{"x":1`, wantErr: "malformed annotation data"},
+		{name: "too many areas", data: tooMany, wantErr: "at most 20 areas"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			displayWidth, displayHeight := 50.0, 40.0
+			if test.noDisplaySize {
+				displayWidth, displayHeight = 0, 0
+			}
+
+			metadata, err := parseAnnotations(test.data, displayWidth, displayHeight, 100, 80)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("error = %v, want it to contain %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if want := (ImageMetadata{Width: 100, Height: 80, Regions: test.want}); !reflect.DeepEqual(metadata, want) {
+				t.Errorf("metadata = %+v, want %+v", metadata, want)
+			}
+		})
+	}
+}
+
+func TestScaleDown(t *testing.T) {
+	checkerboard := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for y := range 4 {
+		for x := range 4 {
+			if (x+y)%2 == 0 {
+				checkerboard.SetRGBA(x, y, color.RGBA{R: 255, G: 255, B: 255, A: 255})
+			} else {
+				checkerboard.SetRGBA(x, y, color.RGBA{A: 255})
+			}
+		}
+	}
+
+	tests := []struct {
+		name      string
+		img       image.Image
+		size      int
+		wantSize  image.Point
+		wantPixel color.RGBA // Of the top left pixel
+	}{
+		{name: "small image copied", img: coordinateImage(image.Rect(0, 0, 30, 20)), size: 240,
+			wantSize: image.Pt(30, 20), wantPixel: color.RGBA{A: 255}},
+		{name: "wide image", img: coordinateImage(image.Rect(0, 0, 480, 200)), size: 240,
+			wantSize: image.Pt(240, 100), wantPixel: color.RGBA{R: 0, G: 0, A: 255}},
+		{name: "tall image", img: coordinateImage(image.Rect(0, 0, 100, 1000)), size: 240,
+			wantSize: image.Pt(24, 240)},
+		{name: "pixels averaged", img: checkerboard, size: 2,
+			wantSize: image.Pt(2, 2), wantPixel: color.RGBA{R: 127, G: 127, B: 127, A: 255}},
+		{name: "image not at the origin", img: coordinateImage(image.Rect(10, 20, 14, 24)), size: 2,
+			wantSize: image.Pt(2, 2), wantPixel: color.RGBA{R: 10, G: 20, A: 255}},
+		{name: "thin line kept", img: coordinateImage(image.Rect(0, 0, 1000, 1)), size: 10,
+			wantSize: image.Pt(10, 1)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scaled := scaleDown(test.img, test.size)
+			if size := scaled.Bounds().Size(); size != test.wantSize {
+				t.Fatalf("scaled to %v, want %v", size, test.wantSize)
+			}
+			if test.wantPixel != (color.RGBA{}) && scaled.RGBAAt(0, 0) != test.wantPixel {
+				t.Errorf("top left pixel = %v, want %v", scaled.RGBAAt(0, 0), test.wantPixel)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/gif" // Register the decoders of the accepted formats
+	_ "image/jpeg"
+	_ "image/png"
+	"net/http"
+	"strings"
+)
+
+// maxImagePixels rejects images that are small files but would take huge amounts of memory once decoded.
+const maxImagePixels = 64 << 20 // 64 megapixels
+
+// imageExtensions are the accepted image types with the file extension they are stored with.
+var imageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// imageInfo describes a validated image.
+type imageInfo struct {
+	MediaType string
+	Width     int
+	Height    int
+}
+
+// inspectImage checks that data is a JPEG, PNG or GIF image by its magic bytes and by decoding it. WebP images
+// are not accepted, as Go's standard library can't decode them to check them.
+// The type the client claims for the file doesn't matter.
+func inspectImage(data []byte) (imageInfo, error) {
+	mediaType, _, _ := strings.Cut(http.DetectContentType(data), ";")
+	if _, ok := imageExtensions[mediaType]; !ok {
+		return imageInfo{}, fmt.Errorf("unsupported file type %s, only JPG, PNG and GIF images are accepted", mediaType)
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return imageInfo{}, fmt.Errorf("the image is damaged: %w", err)
+	}
+	info := imageInfo{MediaType: mediaType, Width: config.Width, Height: config.Height}
+
+	if info.Width <= 0 || info.Height <= 0 {
+		return imageInfo{}, fmt.Errorf("the image is empty")
+	}
+	if info.Width*info.Height > maxImagePixels {
+		return imageInfo{}, fmt.Errorf("the image has %dx%d pixels, at most %d megapixels are accepted",
+			info.Width, info.Height, maxImagePixels>>20)
+	}
+
+	if _, _, err := image.Decode(bytes.NewReader(data)); err != nil {
+		return imageInfo{}, fmt.Errorf("the image is damaged: %w", err)
+	}
+	return info, nil
+}
@@ -0,0 +1,74 @@
+package services
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// encodeImage returns a width x height image in the given format.
+func encodeImage(t *testing.T, format string, width, height int) []byte {
+	t.Helper()
+	img := image.NewPaletted(image.Rect(0, 0, width, height), color.Palette{color.White, color.Black})
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "png":
+		err = png.Encode(&buf, img)
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, nil)
+	case "gif":
+		err = gif.Encode(&buf, img, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// gifHeader returns the start of a GIF claiming the given size, which is all DecodeConfig reads.
+func gifHeader(width, height int) []byte {
+	return append([]byte("GIF89a"), byte(width), byte(width>>8), byte(height), byte(height>>8), 0, 0, 0)
+}
+
+func TestInspectImage(t *testing.T) {
+	pngImage := encodeImage(t, "png", 4, 3)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    imageInfo
+		wantErr string
+	}{
+		{name: "png", data: pngImage, want: imageInfo{MediaType: "image/png", Width: 4, Height: 3}},
+		{name: "jpeg", data: encodeImage(t, "jpeg", 5, 2), want: imageInfo{MediaType: "image/jpeg", Width: 5, Height: 2}},
+		{name: "gif", data: encodeImage(t, "gif", 1, 1), want: imageInfo{MediaType: "image/gif", Width: 1, Height: 1}},
+		{name: "webp", data: []byte("RIFF\x24\x00\x00\x00WEBPVP8 \x18\x00\x00\x00\x30\x01\x00\x9d\x01\x2a\x04\x00\x03\x00"),
+			wantErr: "unsupported file type image/webp"},
+		{name: "text", data: []byte("Not an image"), wantErr: "unsupported file type text/plain"},
+		{name: "truncated", data: pngImage[:len(pngImage)/2], wantErr: "damaged"},
+		{name: "header only", data: gifHeader(4, 3), wantErr: "damaged"},
+		{name: "empty", data: gifHeader(0, 3), wantErr: "empty"},
+		{name: "too many pixels", data: gifHeader(9000, 9000), wantErr: "at most 64 megapixels"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			info, err := inspectImage(test.data)
+			if test.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Fatalf("error = %v, want it to contain %q", err, test.wantErr)
+			}
+			if info != test.want {
+				t.Errorf("info = %+v, want %+v", info, test.want)
+			}
+		})
+	}
+}
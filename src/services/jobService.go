@@ -0,0 +1,204 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// JobService ingests texts into the vector database in the background, one job at a time. Jobs are persisted
+// in the jobs table, so they survive a restart, and can be cancelled while queued or running.
+type JobService struct {
+	mu            sync.Mutex
+	wake          chan struct{}
+	cancelRunning map[int64]context.CancelFunc
+	vectorService *VectorService
+	ollamaService *OllamaService
+}
+
+// SetUpJobService creates the job service and starts working off the queued jobs.
+func SetUpJobService(vectorService *VectorService, ollamaService *OllamaService) *JobService {
+	s := &JobService{
+		wake:          make(chan struct{}, 1),
+		cancelRunning: make(map[int64]context.CancelFunc),
+		vectorService: vectorService,
+		ollamaService: ollamaService,
+	}
+	go s.work()
+	s.notify() // Pick up jobs queued before a restart
+	return s
+}
+
+// SubmitIngestion queues a text to be chunked, embedded and stored as a new document.
+func (s *JobService) SubmitIngestion(name string, source string, text string, options ChunkOptions) (*Job, error) {
+	job, err := s.createIngestion(name, source, text, options)
+	if err != nil {
+		return nil, err
+	}
+	s.notify()
+	return job, nil
+}
+
+// SubmitImageAnalysis queues an image analysis to be added to the vector database as a document of its own.
+// Analyses which are in the vector database already, or on their way, are refused.
+func (s *JobService) SubmitImageAnalysis(analysis *ImageAnalysis) (*Job, error) {
+	if analysis.InKnowledgeBase() {
+		return nil, fmt.Errorf("%s is in the knowledge base already", analysis.DocumentName())
+	}
+	if analysis.JobStatus == JobQueued || analysis.JobStatus == JobRunning {
+		return nil, fmt.Errorf("%s is being added to the knowledge base already", analysis.DocumentName())
+	}
+
+	job, err := s.createIngestion(analysis.DocumentName(), "image analysis", analysis.DocumentText(),
+		DefaultChunkOptions(ChunkSentences))
+	if err != nil {
+		return nil, err
+	}
+	// Link the job before waking the worker, whose queries would fail while the database is locked
+	defer s.notify()
+	if err := s.vectorService.setImageAnalysisJob(analysis.ID, job.ID); err != nil {
+		return nil, err
+	}
+	analysis.JobID, analysis.JobStatus = job.ID, job.Status
+	return job, nil
+}
+
+// SubmitReindex queues a document to be chunked and embedded again, replacing its chunks once all of them are
+// embedded. Options without a strategy keep the ones the document was indexed with.
+func (s *JobService) SubmitReindex(documentID int64, options ChunkOptions) (*Job, error) {
+	document, err := s.vectorService.GetDocument(documentID)
+	if err != nil {
+		return nil, err
+	}
+	if options.Strategy == "" {
+		options = document.ChunkOptions()
+	}
+	if _, err := NewChunker(options); err != nil {
+		return nil, err
+	}
+
+	job, err := s.vectorService.createReindexJob(document, options)
+	if err != nil {
+		return nil, err
+	}
+	s.notify()
+	return job, nil
+}
+
+func (s *JobService) createIngestion(name string, source string, text string, options ChunkOptions) (*Job, error) {
+	if _, err := NewChunker(options); err != nil {
+		return nil, err
+	}
+	return s.vectorService.createJob(name, source, text, options)
+}
+
+// Get returns the current state of a job.
+func (s *JobService) Get(id int64) (*Job, error) {
+	return s.vectorService.GetJob(id)
+}
+
+// Cancel stops a queued or running job. A running job rolls back everything it inserted so far.
+func (s *JobService) Cancel(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if cancel, ok := s.cancelRunning[id]; ok {
+		cancel()
+		return nil
+	}
+
+	job, err := s.vectorService.GetJob(id)
+	if err != nil {
+		return err
+	}
+	if job.Status != JobQueued {
+		return fmt.Errorf("job %d is already %s", id, job.Status)
+	}
+	return s.vectorService.finishJob(id, JobCancelled, nil, "")
+}
+
+// notify wakes up the worker, unless it was already woken up.
+func (s *JobService) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// work runs the queued jobs one after another and waits for new ones when the queue is empty.
+func (s *JobService) work() {
+	for range s.wake {
+		for {
+			id, err := s.vectorService.nextQueuedJobID()
+			if err != nil {
+				log.Printf("Failed to get next job: %v\n", err)
+				break
+			}
+			if id == 0 {
+				break
+			}
+			s.run(id)
+		}
+	}
+}
+
+func (s *JobService) run(id int64) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Claim the job, unless it was cancelled in the meantime
+	s.mu.Lock()
+	claimed, err := s.vectorService.transitionJob(id, JobQueued, JobRunning)
+	if claimed {
+		s.cancelRunning[id] = cancel
+	}
+	s.mu.Unlock()
+	if err != nil {
+		log.Printf("Failed to start job %d: %v\n", id, err)
+		return
+	}
+	if !claimed {
+		return
+	}
+
+	document, err := s.ingest(ctx, id)
+
+	s.mu.Lock()
+	delete(s.cancelRunning, id)
+	s.mu.Unlock()
+
+	// A job cancelled after its commit is done nevertheless
+	switch {
+	case err == nil:
+		err = s.vectorService.finishJob(id, JobDone, document, "")
+	case errors.Is(ctx.Err(), context.Canceled):
+		log.Printf("Job %d was cancelled\n", id)
+		err = s.vectorService.finishJob(id, JobCancelled, nil, "")
+	default:
+		log.Printf("Job %d failed: %v\n", id, err)
+		err = s.vectorService.finishJob(id, JobFailed, nil, err.Error())
+	}
+	if err != nil {
+		log.Printf("Failed to finish job %d: %v\n", id, err)
+	}
+}
+
+func (s *JobService) ingest(ctx context.Context, id int64) (*Document, error) {
+	job, err := s.vectorService.GetJob(id)
+	if err != nil {
+		return nil, err
+	}
+
+	onProgress := func(done int, total int) {
+		// Progress is informational, a failed update must not fail the job
+		if err := s.vectorService.updateJobProgress(id, done, total); err != nil {
+			log.Printf("Job %d: %v\n", id, err)
+		}
+	}
+	if job.ReindexID != 0 {
+		return s.vectorService.ReindexDocument(ctx, job.ReindexID, job.ChunkOptions(), s.ollamaService, onProgress)
+	}
+	return s.vectorService.IngestDocument(ctx, job.Name, job.Source, job.Content, job.ChunkOptions(), s.ollamaService, onProgress)
+}
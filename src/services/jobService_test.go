@@ -0,0 +1,172 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+// waitForJob polls a job until it is no longer queued or running. Like the polling of the web page, it
+// retries reads failing while the worker writes to the database.
+func waitForJob(t *testing.T, jobService *JobService, id int64) *Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job, err := jobService.Get(id)
+		if err == nil && job.Status != JobQueued && job.Status != JobRunning {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %d didn't finish: %+v (%v)", id, job, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitForRunningJob polls a running job until ready reports true for it.
+func waitForRunningJob(t *testing.T, jobService *JobService, id int64, ready func(job *Job) bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job, err := jobService.Get(id)
+		if err == nil && job.Status == JobRunning && ready(job) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %d didn't get ready: %+v (%v)", id, job, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSubmitReindex(t *testing.T) {
+	s := newTestVectorService(t)
+	jobService := SetUpJobService(s, fakeOllamaEmbed(t))
+	sentences := ChunkOptions{Strategy: ChunkSentences, Size: 1, Overlap: 0}
+
+	ingested := waitForJob(t, jobService, submit(t)(jobService.SubmitIngestion("First", "test", "One. Two. Three.", sentences)))
+	if ingested.Status != JobDone {
+		t.Fatalf("ingestion %s: %s", ingested.Status, ingested.Error)
+	}
+
+	// A document whose chunks all belong to another document, like one stored after the other
+	var duplicateID int64
+	err := s.db.QueryRow(`INSERT INTO documents (name, source, content_hash, content, chunk_strategy, chunk_size, chunk_overlap)
+		VALUES ('Second', 'test', 'hash', 'Three.', 'sentence', 1, 0) RETURNING id`).Scan(&duplicateID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		documentID int64
+		options    ChunkOptions
+		wantChunks int
+	}{
+		{name: "new chunk settings", documentID: ingested.DocumentID, options: ChunkOptions{Strategy: ChunkSentences, Size: 2, Overlap: 0}, wantChunks: 2},
+		{name: "stored settings", documentID: ingested.DocumentID, wantChunks: 2},
+		{name: "all chunks in another document", documentID: duplicateID, wantChunks: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			job := waitForJob(t, jobService, submit(t)(jobService.SubmitReindex(test.documentID, test.options)))
+			if job.Status != JobDone {
+				t.Fatalf("re-index %s: %s", job.Status, job.Error)
+			}
+			if job.ReindexID != test.documentID {
+				t.Errorf("job re-indexed document %d, want %d", job.ReindexID, test.documentID)
+			}
+
+			document, err := s.GetDocument(test.documentID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if document.ChunkCount != test.wantChunks {
+				t.Errorf("document has %d chunks, want %d", document.ChunkCount, test.wantChunks)
+			}
+		})
+	}
+}
+
+func TestCancelRunningJob(t *testing.T) {
+	sentences := ChunkOptions{Strategy: ChunkSentences, Size: 1, Overlap: 0}
+
+	// The job is cancelled while the fake Ollama takes its time to answer, or once all chunks are embedded
+	// while the test holds back storing them
+	tests := []struct {
+		name           string
+		reindex        bool
+		whileEmbedding bool
+	}{
+		{name: "ingestion while embedding", whileEmbedding: true},
+		{name: "ingestion before storing"},
+		{name: "re-index while embedding", reindex: true, whileEmbedding: true},
+		{name: "re-index before storing", reindex: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestVectorService(t)
+			ollamaService, backend := fakeOllamaEmbedBackend(t)
+			var wantDocuments, wantChunks int
+			var first *Document
+			if test.reindex {
+				first = ingestTestDocument(t, s, ollamaService, "First", "One. Two. Three.")
+				wantDocuments, wantChunks = 1, 3
+			}
+			jobService := SetUpJobService(s, ollamaService)
+
+			ready := func(job *Job) bool { return job.ChunksTotal > 0 && job.ChunksDone == job.ChunksTotal }
+			if test.whileEmbedding {
+				backend.delay = time.Minute // Cut short when the job gives up the request
+				ready = func(job *Job) bool { return true }
+			} else {
+				s.vectorsMu.Lock()
+			}
+			var id int64
+			if test.reindex {
+				id = submit(t)(jobService.SubmitReindex(first.ID, ChunkOptions{Strategy: ChunkSentences, Size: 2, Overlap: 0}))
+			} else {
+				id = submit(t)(jobService.SubmitIngestion("Second", "test", "Four. Five. Six.", sentences))
+			}
+			waitForRunningJob(t, jobService, id, ready)
+			err := jobService.Cancel(id)
+			if !test.whileEmbedding {
+				s.vectorsMu.Unlock()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			job := waitForJob(t, jobService, id)
+			if job.Status != JobCancelled || job.DocumentID != 0 {
+				t.Errorf("job %s with document %d, want it cancelled without document", job.Status, job.DocumentID)
+			}
+			documents, err := s.ListDocuments()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(documents) != wantDocuments {
+				t.Errorf("%d documents stored, want %d", len(documents), wantDocuments)
+			}
+			for _, table := range []string{"vectors", "vectors_fts"} {
+				var count int
+				if err := s.db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil {
+					t.Fatal(err)
+				}
+				if count != wantChunks {
+					t.Errorf("%d chunks in %s, want %d", count, table, wantChunks)
+				}
+			}
+		})
+	}
+}
+
+// submit fails the test if submitting a job failed and returns its id otherwise.
+func submit(t *testing.T) func(*Job, error) int64 {
+	return func(job *Job, err error) int64 {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return job.ID
+	}
+}
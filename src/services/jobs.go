@@ -0,0 +1,212 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// JobStatus is the state of an ingestion job.
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobDone      JobStatus = "done"
+	JobFailed    JobStatus = "failed"
+	JobCancelled JobStatus = "cancelled"
+)
+
+// Job is a text waiting to be, being or already ingested into the vector database by the JobService.
+// A re-index job chunks and embeds a stored document again instead.
+type Job struct {
+	ID            int64
+	Name          string
+	Source        string
+	Content       string // Cleared once the job has finished, empty for re-index jobs
+	ReindexID     int64  // Document whose chunks the job replaces, 0 if it adds a new document
+	ChunkStrategy ChunkStrategy
+	ChunkSize     int
+	ChunkOverlap  int
+	Status        JobStatus
+	ChunksTotal   int // Known once the text was chunked
+	ChunksDone    int // Chunks embedded so far
+	ChunksSkipped int // Chunks not embedded, because they are stored already
+	DocumentID    int64
+	Error         string
+	CreatedAt     string
+	UpdatedAt     string
+}
+
+// ChunkOptions returns the options the job chunks its text with.
+func (j *Job) ChunkOptions() ChunkOptions {
+	return ChunkOptions{Strategy: j.ChunkStrategy, Size: j.ChunkSize, Overlap: j.ChunkOverlap}
+}
+
+// Active reports whether the job is still queued or running.
+func (j *Job) Active() bool {
+	return j.Status == JobQueued || j.Status == JobRunning
+}
+
+// Percent returns the embedding progress of the job in percent.
+func (j *Job) Percent() int {
+	if j.ChunksTotal == 0 {
+		return 0
+	}
+	return j.ChunksDone * 100 / j.ChunksTotal
+}
+
+func (s *VectorService) createJobsTable() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS jobs (
+		id INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		source TEXT NOT NULL,
+		content TEXT NOT NULL,
+		chunk_strategy TEXT NOT NULL,
+		chunk_size INTEGER NOT NULL,
+		chunk_overlap INTEGER NOT NULL,
+		status TEXT NOT NULL,
+		chunks_total INTEGER NOT NULL DEFAULT 0,
+		chunks_done INTEGER NOT NULL DEFAULT 0,
+		document_id INTEGER REFERENCES documents(id) ON DELETE SET NULL,
+		error TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		updated_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+	) STRICT`)
+	if err != nil {
+		return fmt.Errorf("failed to create jobs table: %w", err)
+	}
+	if err := s.addColumnIfMissing("jobs", "chunks_skipped", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	// No foreign key: re-indexing a document deleted in the meantime fails the job instead of dropping it
+	if err := s.addColumnIfMissing("jobs", "reindex_document_id", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec("CREATE INDEX IF NOT EXISTS jobs_status_idx ON jobs (status, id)")
+	if err != nil {
+		return fmt.Errorf("failed to create jobs index: %w", err)
+	}
+
+	// Jobs interrupted by a restart stored nothing, as chunks are only committed at the very end
+	_, err = s.db.Exec("UPDATE jobs SET status=?, chunks_done=0 WHERE status=?", JobQueued, JobRunning)
+	if err != nil {
+		return fmt.Errorf("failed to requeue interrupted jobs: %w", err)
+	}
+	return nil
+}
+
+// createJob queues a new ingestion job.
+func (s *VectorService) createJob(name string, source string, text string, options ChunkOptions) (*Job, error) {
+	return s.insertJob(Job{
+		Name:          name,
+		Source:        source,
+		Content:       text,
+		ChunkStrategy: options.Strategy,
+		ChunkSize:     options.Size,
+		ChunkOverlap:  options.Overlap,
+		Status:        JobQueued,
+	})
+}
+
+// createReindexJob queues a job re-indexing a document with the given chunk options.
+func (s *VectorService) createReindexJob(document *Document, options ChunkOptions) (*Job, error) {
+	return s.insertJob(Job{
+		Name:          document.Name,
+		Source:        document.Source,
+		ReindexID:     document.ID,
+		ChunkStrategy: options.Strategy,
+		ChunkSize:     options.Size,
+		ChunkOverlap:  options.Overlap,
+		Status:        JobQueued,
+	})
+}
+
+func (s *VectorService) insertJob(job Job) (*Job, error) {
+	err := s.db.QueryRow(`INSERT INTO jobs (name, source, content, reindex_document_id, chunk_strategy, chunk_size, chunk_overlap, status)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?) RETURNING id, created_at, updated_at`,
+		job.Name, job.Source, job.Content, job.ReindexID, job.ChunkStrategy, job.ChunkSize, job.ChunkOverlap, job.Status,
+	).Scan(&job.ID, &job.CreatedAt, &job.UpdatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create job: %w", err)
+	}
+	return &job, nil
+}
+
+// GetJob returns a job including its remaining content.
+func (s *VectorService) GetJob(id int64) (*Job, error) {
+	job, err := scanJob(s.db.QueryRow(`SELECT id, name, source, content, reindex_document_id, chunk_strategy, chunk_size, chunk_overlap,
+			status, chunks_total, chunks_done, chunks_skipped, document_id, error, created_at, updated_at
+		FROM jobs WHERE id=?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("job %d not found", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get job: %w", err)
+	}
+	return job, nil
+}
+
+// nextQueuedJobID returns the oldest queued job, or 0 if no job is waiting.
+func (s *VectorService) nextQueuedJobID() (int64, error) {
+	var id int64
+	err := s.db.QueryRow("SELECT id FROM jobs WHERE status=? ORDER BY id LIMIT 1", JobQueued).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get next job: %w", err)
+	}
+	return id, nil
+}
+
+// transitionJob changes the status of a job, but only if it currently has the expected status.
+// It reports whether the job was changed.
+func (s *VectorService) transitionJob(id int64, from JobStatus, to JobStatus) (bool, error) {
+	result, err := s.db.Exec("UPDATE jobs SET status=?, updated_at=CURRENT_TIMESTAMP WHERE id=? AND status=?", to, id, from)
+	if err != nil {
+		return false, fmt.Errorf("failed to update job: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to update job: %w", err)
+	}
+	return affected > 0, nil
+}
+
+// updateJobProgress stores the chunk counters of a running job.
+func (s *VectorService) updateJobProgress(id int64, done int, total int) error {
+	_, err := s.db.Exec("UPDATE jobs SET chunks_done=?, chunks_total=?, updated_at=CURRENT_TIMESTAMP WHERE id=?", done, total, id)
+	if err != nil {
+		return fmt.Errorf("failed to update job progress: %w", err)
+	}
+	return nil
+}
+
+// finishJob stores the outcome of a job and drops its content, which is either stored in the document by now
+// or not wanted anymore. The document is nil unless the job is done.
+func (s *VectorService) finishJob(id int64, status JobStatus, document *Document, message string) error {
+	var documentID, skipped int64
+	if document != nil {
+		documentID, skipped = document.ID, int64(document.DuplicateChunks)
+	}
+	_, err := s.db.Exec(`UPDATE jobs SET status=?, document_id=NULLIF(?, 0), chunks_skipped=?, error=?, content='',
+		updated_at=CURRENT_TIMESTAMP WHERE id=?`, status, documentID, skipped, message, id)
+	if err != nil {
+		return fmt.Errorf("failed to finish job: %w", err)
+	}
+	return nil
+}
+
+func scanJob(row *sql.Row) (*Job, error) {
+	var job Job
+	var documentID sql.NullInt64
+	err := row.Scan(&job.ID, &job.Name, &job.Source, &job.Content, &job.ReindexID, &job.ChunkStrategy, &job.ChunkSize, &job.ChunkOverlap,
+		&job.Status, &job.ChunksTotal, &job.ChunksDone, &job.ChunksSkipped, &documentID, &job.Error, &job.CreatedAt, &job.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	job.DocumentID = documentID.Int64
+	return &job, nil
+}
@@ -0,0 +1,73 @@
+package services
+
+import (
+	"slices"
+	"strings"
+)
+
+// Model is a model offered by a provider. Only Ollama reports its details.
+type Model struct {
+	Name       string       `json:"name"`
+	Model      string       `json:"model"`
+	ModifiedAt string       `json:"modified_at"`
+	Size       int64        `json:"size"`
+	Details    ModelDetails `json:"details"`
+
+	// ReportedCapabilities are the capabilities the provider reports for the model, nil if it doesn't
+	ReportedCapabilities []ModelCapability `json:"-"`
+}
+
+type ModelDetails struct {
+	Format            string   `json:"format"`
+	Family            string   `json:"family"`
+	Families          []string `json:"families"`
+	ParameterSize     string   `json:"parameter_size"`
+	QuantizationLevel string   `json:"quantization_level"`
+}
+
+// ModelCapability is what a model can be used for.
+type ModelCapability string
+
+const (
+	CapabilityChat      ModelCapability = "chat"
+	CapabilityEmbedding ModelCapability = "embedding"
+	CapabilityVision    ModelCapability = "vision"
+)
+
+// Model families of embedding models and of the image encoders of vision models, as reported by Ollama.
+var (
+	embeddingFamilies = []string{"bert", "nomic-bert", "xlm-roberta"}
+	visionFamilies    = []string{"clip", "mllama"}
+)
+
+// Capabilities returns what the model can be used for. Unless the provider reported it, it is guessed from
+// the families and name of the model: embedding models can't chat, vision models can chat and look at images.
+func (m Model) Capabilities() []ModelCapability {
+	if m.ReportedCapabilities != nil {
+		return m.ReportedCapabilities
+	}
+
+	name := strings.ToLower(m.Name)
+	families := append([]string{m.Details.Family}, m.Details.Families...)
+
+	if strings.Contains(name, "embed") || slices.ContainsFunc(families, isOneOf(embeddingFamilies)) {
+		return []ModelCapability{CapabilityEmbedding}
+	}
+	if slices.ContainsFunc(families, isOneOf(visionFamilies)) ||
+		slices.ContainsFunc([]string{"vision", "llava", "vl"}, func(part string) bool { return strings.Contains(name, part) }) {
+		return []ModelCapability{CapabilityChat, CapabilityVision}
+	}
+	return []ModelCapability{CapabilityChat}
+}
+
+// Supports reports whether the model has the capability, see Capabilities.
+func (m Model) Supports(capability ModelCapability) bool {
+	return slices.Contains(m.Capabilities(), capability)
+}
+
+// isOneOf returns a function reporting whether a model family is one of the given ones.
+func isOneOf(families []string) func(string) bool {
+	return func(family string) bool {
+		return slices.Contains(families, strings.ToLower(family))
+	}
+}
@@ -0,0 +1,117 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hvossi92/gollama/src/utils"
+)
+
+// ollamaProvider speaks Ollama's native API.
+type ollamaProvider struct {
+	chatEndpoint      string
+	embeddingEndpoint string
+	tagsEndpoint      string
+	showEndpoint      string
+}
+
+// ShowRequest asks Ollama's /api/show endpoint for the details of a model.
+type ShowRequest struct {
+	Model string `json:"model"`
+}
+
+type ShowResponse struct {
+	Capabilities []string `json:"capabilities"` // E.g. "completion", "vision" or "embedding", missing before Ollama 0.6
+}
+
+func newOllamaProvider(url string) *ollamaProvider {
+	return &ollamaProvider{
+		chatEndpoint:      url + "/api/chat",
+		embeddingEndpoint: url + "/api/embed",
+		tagsEndpoint:      url + "/api/tags",
+		showEndpoint:      url + "/api/show",
+	}
+}
+
+func (p *ollamaProvider) Chat(ctx context.Context, model string, messages []ChatMessage, onToken func(token string) error) (string, error) {
+	request := ChatRequest{
+		Model:    model,
+		Messages: messages,
+		Stream:   onToken != nil,
+	}
+
+	if onToken == nil {
+		response, err := utils.SendPostRequestWithHeaders[ChatRequest, ChatResponse](ctx, p.chatEndpoint, nil, request)
+		if err != nil {
+			return "", err
+		}
+		return response.Message.Content, nil
+	}
+
+	var answer strings.Builder
+	err := utils.StreamPostRequest(ctx, p.chatEndpoint, request, func(chunk *ChatResponse) (bool, error) {
+		if chunk.Error != "" {
+			return false, fmt.Errorf("error from Ollama: %s", chunk.Error)
+		}
+		if chunk.Message.Content != "" {
+			answer.WriteString(chunk.Message.Content)
+			if err := onToken(chunk.Message.Content); err != nil {
+				return false, err
+			}
+		}
+		return chunk.Done, nil
+	})
+	return answer.String(), err
+}
+
+func (p *ollamaProvider) Embed(ctx context.Context, model string, texts []string) ([][]float32, error) {
+	request := EmbeddingRequest{
+		Model: model,
+		Input: texts,
+	}
+
+	response, err := utils.SendPostRequestWithHeaders[EmbeddingRequest, EmbeddingResponse](ctx, p.embeddingEndpoint, nil, request)
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Embeddings) != len(texts) {
+		return nil, fmt.Errorf("expected %d embeddings, but got %d", len(texts), len(response.Embeddings))
+	}
+	return response.Embeddings, nil
+}
+
+// showTimeout bounds a lookup of the details of a model. Like a GET request it only queries metadata, so it
+// should fail fast if the server is unreachable.
+const showTimeout = 10 * time.Second
+
+func (p *ollamaProvider) ModelCapabilities(model string) ([]ModelCapability, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), showTimeout)
+	defer cancel()
+	response, err := utils.SendPostRequestWithHeaders[ShowRequest, ShowResponse](ctx, p.showEndpoint, nil, ShowRequest{Model: model})
+	if err != nil {
+		return nil, err
+	}
+
+	var capabilities []ModelCapability
+	for _, capability := range response.Capabilities {
+		switch capability {
+		case "completion":
+			capabilities = append(capabilities, CapabilityChat)
+		case "embedding":
+			capabilities = append(capabilities, CapabilityEmbedding)
+		case "vision":
+			capabilities = append(capabilities, CapabilityVision)
+		}
+	}
+	return capabilities, nil
+}
+
+func (p *ollamaProvider) ListModels() ([]Model, error) {
+	response, err := utils.SendGetRequest[TagsResponse](p.tagsEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	return response.Models, nil
+}
@@ -1,23 +1,43 @@
 package services
 
 import (
-	"encoding/base64"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
-	"os"
 	"strings"
-
-	"github.com/hvossi92/gollama/src/utils"
+	"sync"
+	"text/template"
 )
 
+// OllamaService talks to the configured LLM backend, Ollama or an OpenAI-compatible server. Its provider and
+// models can be swapped at runtime via Configure, so every holder of the service pointer sees settings changes
+// without a restart.
 type OllamaService struct {
-	chatEndpoint      string
-	generateEndpoint  string
-	embeddingEndpoint string
-	llm               string
-	embeddingModel    string
+	mu       sync.RWMutex
+	config   ollamaConfig
+	batching embeddingBatching
+	cache    *EmbeddingCache
+}
+
+// embeddingBatching limits the number of texts per embedding request and the number of parallel requests.
+type embeddingBatching struct {
+	batchSize int
+	workers   int
+}
+
+// Default limits of EmbedBatch, until they are changed with ConfigureEmbeddingBatches.
+const (
+	DefaultEmbeddingBatchSize = 32
+	DefaultEmbeddingWorkers   = 2
+)
+
+type ollamaConfig struct {
+	provider       Provider
+	url            string
+	llm            string
+	embeddingModel string
+	visionModel    string // Empty if image analysis is not used
 }
 
 // ChatRequest struct to structure the request body
@@ -45,6 +65,7 @@ type ChatResponse struct { // New struct for /api/chat response
 	PromptEvalDuration int64               `json:"prompt_eval_duration"`
 	EvalCount          int                 `json:"eval_count"`
 	EvalDuration       int64               `json:"eval_duration"`
+	Error              string              `json:"error"` // Set instead of the message when Ollama fails while streaming
 }
 
 type GenerateRequest struct {
@@ -73,8 +94,8 @@ type ChatMessageResponse struct { // Struct for the nested "message" object
 }
 
 type EmbeddingRequest struct {
-	Model string `json:"model"`
-	Input string `json:"input"`
+	Model string   `json:"model"`
+	Input []string `json:"input"` // Ollama embeds every input and returns the embeddings in the same order
 }
 
 type EmbeddingResponse struct {
@@ -85,8 +106,17 @@ type EmbeddingResponse struct {
 	Prompt_eval_count int
 }
 
+// ImageMetadata describes the areas the user marked on an image, in pixels of the original image.
 type ImageMetadata struct {
-	CanvasCoordinates []Point `json:"canvas_coordinates"`
+	Width   int      `json:"width"` // Size of the original image
+	Height  int      `json:"height"`
+	Regions []Region `json:"regions"`
+}
+
+// Region is a marked rectangle, from its top left corner up to, but not including, its bottom right corner.
+type Region struct {
+	Min Point `json:"min"`
+	Max Point `json:"max"`
 }
 
 // Point struct for x, y coordinates
@@ -100,98 +130,336 @@ type GenerateOptions struct {
 	Metadata ImageMetadata `json:"metadata,omitempty"` // Use omitempty if metadata is optional
 }
 
-// SetUpVectorDBService creates and initializes a new VectorDBService.
-func SetUpOllamaService(url string, llm string, embedding string) *OllamaService {
-	return &OllamaService{chatEndpoint: url + "/api/chat", generateEndpoint: url + "/api/generate", embeddingEndpoint: url + "/api/embed", llm: llm, embeddingModel: embedding}
+// TagsResponse is the response of Ollama's /api/tags endpoint, listing the locally available models.
+type TagsResponse struct {
+	Models []Model `json:"models"`
+}
+
+// SetUpOllamaService creates the service for the provider and models of the settings.
+func SetUpOllamaService(settings Settings) (*OllamaService, error) {
+	config, err := newOllamaConfig(settings)
+	if err != nil {
+		return nil, err
+	}
+	return &OllamaService{
+		config:   config,
+		batching: embeddingBatching{batchSize: DefaultEmbeddingBatchSize, workers: DefaultEmbeddingWorkers},
+	}, nil
+}
+
+func newOllamaConfig(settings Settings) (ollamaConfig, error) {
+	provider, err := NewProvider(settings.Provider, settings.URL, settings.APIKey)
+	if err != nil {
+		return ollamaConfig{}, err
+	}
+	return ollamaConfig{
+		provider:       provider,
+		url:            strings.TrimRight(settings.URL, "/"),
+		llm:            settings.LLM,
+		embeddingModel: settings.Embedding,
+		visionModel:    settings.VisionModel,
+	}, nil
+}
+
+// Configure swaps the provider and models of the running service. Requests already in flight
+// finish with the previous configuration.
+func (s *OllamaService) Configure(settings Settings) error {
+	config, err := newOllamaConfig(settings)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config = config
+	return nil
+}
+
+// ConfigureEmbeddingBatches sets how many texts EmbedBatch sends per request and how many requests run in parallel.
+func (s *OllamaService) ConfigureEmbeddingBatches(batchSize int, workers int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batching = embeddingBatching{batchSize: max(batchSize, 1), workers: max(workers, 1)}
+}
+
+// SetEmbeddingCache makes GetVectorEmbedding and EmbedBatch reuse the embeddings of texts embedded before.
+func (s *OllamaService) SetEmbeddingCache(cache *EmbeddingCache) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cache = cache
+}
+
+func (s *OllamaService) currentConfig() ollamaConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.config
+}
+
+// EmbeddingModel returns the name of the configured embedding model.
+func (s *OllamaService) EmbeddingModel() string {
+	return s.currentConfig().embeddingModel
+}
+
+// VisionModel returns the name of the configured vision model, empty if image analysis is not used.
+func (s *OllamaService) VisionModel() string {
+	return s.currentConfig().visionModel
+}
+
+// ListModels returns the models available from the configured provider.
+func (s *OllamaService) ListModels() ([]Model, error) {
+	provider := s.currentConfig().provider
+	models, err := provider.ListModels()
+	if err != nil {
+		return nil, err
+	}
+	return withReportedCapabilities(provider, models), nil
+}
+
+// ListModelsFor returns the models available from the provider of the settings, which don't have to be
+// applied yet. For Ollama, the models are listed with /api/tags and their capabilities looked up with /api/show.
+func (s *OllamaService) ListModelsFor(settings Settings) ([]Model, error) {
+	provider, models, err := listProviderModels(settings)
+	if err != nil {
+		return nil, err
+	}
+	return withReportedCapabilities(provider, models), nil
+}
+
+// listProviderModels creates the provider of the settings and lists its models, without looking up their capabilities.
+func listProviderModels(settings Settings) (Provider, []Model, error) {
+	provider, err := NewProvider(settings.Provider, settings.URL, settings.APIKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	models, err := provider.ListModels()
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not reach %s at %s: %w", settings.Provider.DisplayName(), settings.URL, err)
+	}
+	return provider, models, nil
+}
+
+// capabilityLookups is the number of models whose capabilities are looked up at the same time.
+const capabilityLookups = 8
+
+// withReportedCapabilities sets the capabilities the provider reports for the models, looking up several
+// models at once. Models it reports nothing for keep the guess of Model.Capabilities.
+func withReportedCapabilities(provider Provider, models []Model) []Model {
+	var wg sync.WaitGroup
+	lookups := make(chan struct{}, capabilityLookups)
+	for i := range models {
+		wg.Add(1)
+		lookups <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-lookups }()
+
+			capabilities, err := provider.ModelCapabilities(models[i].Name)
+			if err != nil {
+				log.Printf("Failed to look up the capabilities of %s: %v\n", models[i].Name, err)
+				return
+			}
+			models[i].ReportedCapabilities = capabilities
+		}()
+	}
+	wg.Wait()
+	return models
+}
+
+// ValidateSettings checks that the provider of the settings responds at their URL and provides both
+// models, and that the vision model, if any, can look at images, before they are applied with Configure.
+// Whether a vision model can look at images is only enforced if the provider reports it. Otherwise a model
+// whose name and family don't suggest it is accepted with the returned warning, as the guess may be wrong.
+func (s *OllamaService) ValidateSettings(settings Settings) (string, error) {
+	if settings.LLM == "" || settings.Embedding == "" {
+		return "", fmt.Errorf("both an LLM and an embedding model are required")
+	}
+
+	// Only the vision model needs its capabilities, so the others are not looked up
+	provider, models, err := listProviderModels(settings)
+	if err != nil {
+		return "", err
+	}
+
+	for _, name := range []string{settings.LLM, settings.Embedding} {
+		if !hasModel(models, name) {
+			return "", fmt.Errorf("model %q is not available at %s", name, settings.URL)
+		}
+	}
+
+	if settings.VisionModel != "" {
+		model, ok := FindModel(models, settings.VisionModel)
+		if !ok {
+			return "", fmt.Errorf("model %q is not available at %s", settings.VisionModel, settings.URL)
+		}
+		model = withReportedCapabilities(provider, []Model{model})[0]
+		switch {
+		case model.Supports(CapabilityVision):
+		case model.ReportedCapabilities != nil:
+			return "", fmt.Errorf("model %q does not support images", settings.VisionModel)
+		default:
+			return fmt.Sprintf("%s doesn't report whether model %q supports images, and its name doesn't suggest it. Image analyses fail if it doesn't.",
+				settings.Provider.DisplayName(), settings.VisionModel), nil
+		}
+	}
+	return "", nil
+}
+
+// FindModel returns the model with the given name, treating a missing tag as ":latest" like Ollama does.
+func FindModel(models []Model, name string) (Model, bool) {
+	name = normalizeModelName(name)
+	for _, model := range models {
+		if normalizeModelName(model.Name) == name || normalizeModelName(model.Model) == name {
+			return model, true
+		}
+	}
+	return Model{}, false
+}
+
+// hasModel reports whether name is one of the models, treating a missing tag as ":latest" like Ollama does.
+func hasModel(models []Model, name string) bool {
+	_, ok := FindModel(models, name)
+	return ok
 }
 
-var questionSystemPrompt = `
+func normalizeModelName(name string) string {
+	if name != "" && !strings.Contains(name, ":") {
+		return name + ":latest"
+	}
+	return name
+}
+
+var questionSystemPrompt = template.Must(template.New("question").Parse(`
 You are a helpful assistant with access to a knowlege base, tasked with answering questions about general knowledge, but also specific to the provided knowledge base.
 
 Answer the question in a very concise manner. Use an unbiased and journalistic tone. Do not repeat text. Don't make anything up. If you are not sure about something, just say that you don't know.
 {{- /* Stop here if no context is provided. The rest below is for handling contexts. */ -}}
-{{- if . -}}
+{{- if .Passages}}
+
 If possible, answer the question solely based on the provided search results from the knowledge base. If the search results from the knowledge base are not relevant to the question at hand, try to answer the question based on general knowledge. But do not make anything up.
 
-Anything between the following 'context' XML blocks is retrieved from the knowledge base, not part of the conversation with the user. The bullet points are ordered by relevance, so the first one is the most relevant.
+Anything between the following 'context' XML blocks is retrieved from the knowledge base, not part of the conversation with the user. The passages are numbered and ordered by relevance, so [1] is the most relevant.
+Cite the passages you used by their number in square brackets, e.g. [1] or [2][3], right after the statement they support.
 
 <context>
-    {{- if . -}}
-    {{- range $context := .}}
-    - {{.}}{{end}}
-    {{- end}}
+{{- range .Passages}}
+
+[{{.Number}}] {{.Title}}:
+{{.Text}}
+{{- end}}
 </context>
-{{- end -}}
+{{- else if .Retrieval}}
+
+The knowledge base contains nothing relevant to this question. Answer based on general knowledge if you can, otherwise say that you don't know. Do not make anything up.
+{{- end}}
+
+Don't mention the knowledge base, context or search results in your answer{{if .Passages}}, apart from the citation numbers{{end}}.
+`))
+
+// Citation is a chunk from the vector database that was passed to the LLM as a numbered context passage.
+type Citation struct {
+	Number     int
+	ChunkID    int64
+	DocumentID int64
+	Title      string
+	Text       string
+	Distance   float64
+}
+
+// AskLLM answers a question, replaying the given conversation history so follow-up questions work.
+// It also returns the citations of the context passages the answer is based on.
+func (s *OllamaService) AskLLM(question string, useVectorDb bool, vectorService *VectorService, retrieval RetrievalOptions, history []ChatMessage) (string, []Citation, error) {
+	messages, citations, err := s.buildQuestionMessages(question, useVectorDb, vectorService, retrieval, history)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// 6. Make the Chat Request to the LLM
+	config := s.currentConfig()
+	answer, err := config.provider.Chat(context.Background(), config.llm, messages, nil)
+	if err != nil {
+		fmt.Println(err.Error())
+		return "", nil, err
+	}
+
+	return answer, citations, nil // Return response from LLM
+}
 
-Don't mention the knowledge base, context or search results in your answer.
-`
+// StreamLLM works like AskLLM, but requests a streamed answer from the LLM and calls onToken
+// for every chunk of the answer as it arrives. The complete answer is returned once the LLM is done.
+func (s *OllamaService) StreamLLM(ctx context.Context, question string, useVectorDb bool, vectorService *VectorService, retrieval RetrievalOptions, history []ChatMessage, onToken func(token string) error) (string, []Citation, error) {
+	messages, citations, err := s.buildQuestionMessages(question, useVectorDb, vectorService, retrieval, history)
+	if err != nil {
+		return "", nil, err
+	}
 
-func (s *OllamaService) AskLLM(question string, useVectorDb bool, vectorService *VectorService) (string, error) {
-	var messages []ChatMessage
+	config := s.currentConfig()
+	answer, err := config.provider.Chat(ctx, config.llm, messages, onToken)
+	if err != nil {
+		return answer, citations, fmt.Errorf("failed to stream chat response: %w", err)
+	}
+
+	return answer, citations, nil
+}
 
+// buildQuestionMessages creates the system prompt, the replayed history and the user message for a question.
+// If requested, the system prompt contains numbered context passages from the vector database, which are returned as citations.
+func (s *OllamaService) buildQuestionMessages(question string, useVectorDb bool, vectorService *VectorService, retrieval RetrievalOptions, history []ChatMessage) ([]ChatMessage, []Citation, error) {
+	var citations []Citation
 	if useVectorDb {
 		// 1. Embed the question to find relevant chunks
 		questionEmbedding, err := s.GetVectorEmbedding(question)
 		if err != nil {
-			return "", fmt.Errorf("failed to embed question: %w", err)
+			return nil, nil, fmt.Errorf("failed to embed question: %w", err)
 		}
 
 		// 2. Query vector DB to find similar chunks
-		similarItems, err := vectorService.FindSimilarVectors(questionEmbedding)
+		similarItems, err := vectorService.SearchChunks(question, questionEmbedding, retrieval)
 		if err != nil {
-			return "", fmt.Errorf("failed to find similar vectors: %w", err)
+			return nil, nil, fmt.Errorf("failed to find similar vectors: %w", err)
 		}
 
-		// 3. Construct context from retrieved chunks
-		context := ""
-		if len(similarItems) > 0 {
-			contextBuilder := strings.Builder{}
-			contextBuilder.WriteString("Context:\n")
-			for _, item := range similarItems {
-				contextBuilder.WriteString(item.Text)
-				contextBuilder.WriteString("\n---\n") // Separator between chunks
-			}
-			context = contextBuilder.String()
-		} else {
-			context = "No relevant context found in the database.\n"
+		if len(similarItems) == 0 {
+			log.Println("No relevant context found in the database")
 		}
 
-		// 4. Create prompt with context and question
-		messages = []ChatMessage{
-			{
-				Role:    "system",
-				Content: questionSystemPrompt,
-			}, {
-				Role:    "user",
-				Content: "<context>" + context + "</context>" + "\nQuestion: " + question, // Combine context and question
-			},
-		}
-	} else {
-		// 5. If not using vector DB, use a simple prompt with just the question
-		messages = []ChatMessage{
-			{
-				Role:    "system",
-				Content: questionSystemPrompt,
-			}, {
-				Role:    "user",
-				Content: "Question: " + question,
-			},
+		// 3. Number the retrieved chunks, so the answer can refer to them
+		for i, item := range similarItems {
+			citations = append(citations, Citation{
+				Number:     i + 1,
+				ChunkID:    item.ID,
+				DocumentID: item.DocumentID,
+				Title:      item.Title,
+				Text:       item.Text,
+				Distance:   item.Distance,
+			})
 		}
 	}
 
-	// 6. Make the Chat Request to Ollama
-	request := ChatRequest{ // Use ChatRequest struct
-		Model:    s.llm,
-		Messages: messages,
-		Stream:   false,
+	// 4. Create the system prompt with the context passages
+	var systemPrompt strings.Builder
+	promptData := struct {
+		Retrieval bool
+		Passages  []Citation
+	}{
+		Retrieval: useVectorDb,
+		Passages:  citations,
 	}
-	chatResponse, err := utils.SendPostRequest[ChatRequest, ChatResponse](s.chatEndpoint, request) // Use ChatRequest and ChatResponse
-	if err != nil {
-		fmt.Println(err.Error())
-		return "", err
+	if err := questionSystemPrompt.Execute(&systemPrompt, promptData); err != nil {
+		return nil, nil, fmt.Errorf("failed to render system prompt: %w", err)
 	}
 
-	return chatResponse.Message.Content, nil // Return response from LLM
+	messages := []ChatMessage{
+		{
+			Role:    "system",
+			Content: systemPrompt.String(),
+		},
+	}
+	messages = append(messages, history...)
+	messages = append(messages, ChatMessage{
+		Role:    "user",
+		Content: "Question: " + question,
+	})
+	return messages, citations, nil
 }
 
 var imageSystemPrompt = `SYSTEM PROMPT: You are an expert at analyzing images and pictures. The user may send additional regions of interest in the form of coordinates, denoting user drawn boxes.
@@ -200,75 +468,204 @@ If no boxes are present, analyze the entire image.
 
 When answering, also mention the annotation data, if present.
 
-Annotation data will have the format of the following example:
-Annotation Data: [{"x":14,"y":59.21875,"w":261,"h":85}]
+Annotation data will have the format of the following example, in pixels of the original image:
+Annotation Data: [{"x":14,"y":59,"w":261,"h":85}]
 
 USER QUESTION: `
 
-func (s *OllamaService) SendImageToOllama(question string, imagePath string, annotationData string) (string, error) {
-	modelName := "llama3.2-vision:latest" // Replace with your Ollama model name (or a model that handles images)
+// SendImageToOllama asks the configured vision model a question about an image. The mode decides whether the
+// model gets the whole image, crops of the marked areas or the image with the areas drawn in. The history holds
+// the previous questions and answers about the same image as text; the images are only sent with the new question.
+func (s *OllamaService) SendImageToOllama(question string, imagePath string, annotations ImageMetadata, mode ImageMode, history []ChatMessage) (string, error) {
+	config := s.currentConfig()
+	if config.visionModel == "" {
+		return "", fmt.Errorf("no vision model is configured, choose one in the settings to analyze images")
+	}
 
-	// 1. Load and Base64 Encode Image
-	fmt.Println(imagePath)
-	base64Image, err := loadImageBase64(imagePath)
+	// 1. Load the image and prepare what is sent of it
+	images, mode, err := prepareImages(imagePath, annotations, mode)
 	if err != nil {
-		log.Fatalf("Error loading and encoding image: %v", err)
 		return "", err
 	}
 
+	content := imageQuestion(question, annotations)
+	switch mode {
+	case ImageModeCrop:
+		content += "\n\nThe images show the marked areas in the order of the annotation data, cropped from the image with a small margin."
+	case ImageModeOutline:
+		content += "\n\nThe marked areas are drawn into the image as red rectangles."
+	}
+
 	messages := []ChatMessage{
 		{
 			Role:    "system",
 			Content: imageSystemPrompt,
-		}, {
-			Role:    "user",
-			Content: question + " Annotation Data: " + string(json.RawMessage(annotationData)),
-			Images:  []string{base64Image},
 		},
 	}
-	request := ChatRequest{
-		Model:    modelName,
-		Messages: messages,
-		Stream:   false,
-	}
-
-	response, err := utils.SendPostRequest[ChatRequest, ChatResponse](s.chatEndpoint, request)
+	messages = append(messages, history...)
+	messages = append(messages, ChatMessage{
+		Role:    "user",
+		Content: content,
+		Images:  images,
+	})
+	answer, err := config.provider.Chat(context.Background(), config.visionModel, messages, nil)
 	if err != nil {
 		fmt.Println(err.Error())
 		return "", err
 	}
 
-	return response.Message.Content, nil
+	return answer, nil
 }
 
-// loadImageBase64 loads an image from a file and encodes it to base64
-func loadImageBase64(imagePath string) (string, error) {
-	imgFile, err := os.Open(imagePath)
-	if err != nil {
-		return "", fmt.Errorf("error opening image file: %w", err)
+// imageQuestion appends the annotation data to a question about an image, in the format the system prompt describes.
+func imageQuestion(question string, annotations ImageMetadata) string {
+	type box struct {
+		X int `json:"x"`
+		Y int `json:"y"`
+		W int `json:"w"`
+		H int `json:"h"`
+	}
+	boxes := make([]box, len(annotations.Regions))
+	for i, region := range annotations.Regions {
+		boxes[i] = box{X: region.Min.X, Y: region.Min.Y, W: region.Max.X - region.Min.X, H: region.Max.Y - region.Min.Y}
 	}
-	defer imgFile.Close()
+	annotationData, _ := json.Marshal(boxes) // Can't fail for ints
+	return question + " Annotation Data: " + string(annotationData)
+}
+
+func (s *OllamaService) GetVectorEmbedding(text string) ([]float32, error) {
+	config := s.currentConfig()
+	cache := s.embeddingCache()
 
-	imgBytes, err := io.ReadAll(imgFile)
+	cached, err := cache.lookup(config.embeddingModel, []string{text})
 	if err != nil {
-		return "", fmt.Errorf("error reading image file: %w", err)
+		log.Printf("Embedding cache: %v\n", err)
+	} else if cached[0] != nil {
+		return cached[0], nil
 	}
 
-	base64String := base64.StdEncoding.EncodeToString(imgBytes)
-	return base64String, nil
+	fmt.Println("Generating vector embeddings", config.url)
+	embeddings, err := embedTexts(context.Background(), config, []string{text})
+	if err != nil {
+		fmt.Println(err.Error())
+		return nil, err
+	}
+	if err := cache.store(config.embeddingModel, []string{text}, embeddings); err != nil {
+		log.Printf("Embedding cache: %v\n", err)
+	}
+	return embeddings[0], nil
 }
 
-func (s *OllamaService) GetVectorEmbedding(text string) ([]float32, error) {
-	request := EmbeddingRequest{
-		Model: s.embeddingModel,
-		Input: text,
+// EmbedBatch embeds many texts with few requests: the texts are sent in batches, of which a bounded number
+// is in flight at the same time. Texts found in the embedding cache are not sent at all. The embeddings are
+// returned in the order of the texts. onProgress, if not nil, is called with the number of embedded texts
+// after every batch. No further batches are sent once ctx is cancelled.
+func (s *OllamaService) EmbedBatch(ctx context.Context, texts []string, onProgress func(done int)) ([][]float32, error) {
+	config := s.currentConfig()
+	s.mu.RLock()
+	batching := s.batching
+	s.mu.RUnlock()
+	cache := s.embeddingCache()
+
+	// The cache is an optimization, embedding without it is slower but correct
+	embeddings, err := cache.lookup(config.embeddingModel, texts)
+	if err != nil {
+		log.Printf("Embedding cache: %v\n", err)
+		embeddings = make([][]float32, len(texts))
+	}
+	var missing []int
+	for i, embedding := range embeddings {
+		if embedding == nil {
+			missing = append(missing, i)
+		}
+	}
+	done := len(texts) - len(missing)
+	if done > 0 && onProgress != nil {
+		onProgress(done)
 	}
 
-	fmt.Println("Generating vector embeddings", s.embeddingEndpoint)
-	ollamaResponse, err := utils.SendPostRequest[EmbeddingRequest, EmbeddingResponse](s.embeddingEndpoint, request)
+	log.Printf("Embedding %d texts (%d cached) in batches of %d with %d workers\n",
+		len(texts), done, batching.batchSize, batching.workers)
+
+	batches := make(chan []int)
+	go func() {
+		defer close(batches)
+		for start := 0; start < len(missing); start += batching.batchSize {
+			batches <- missing[start:min(start+batching.batchSize, len(missing))]
+		}
+	}()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	for range min(batching.workers, len(missing)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				mu.Lock()
+				if firstErr == nil && ctx.Err() != nil {
+					firstErr = ctx.Err()
+				}
+				failed := firstErr != nil
+				mu.Unlock()
+				if failed {
+					continue // Drain the remaining batches without sending them
+				}
+
+				batchTexts := make([]string, len(batch))
+				for i, index := range batch {
+					batchTexts[i] = texts[index]
+				}
+				result, err := embedTexts(ctx, config, batchTexts)
+				if err == nil {
+					if err := cache.store(config.embeddingModel, batchTexts, result); err != nil {
+						log.Printf("Embedding cache: %v\n", err)
+					}
+				}
+
+				mu.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = fmt.Errorf("failed to embed texts %d to %d: %w", batch[0]+1, batch[len(batch)-1]+1, err)
+					}
+				} else {
+					for i, index := range batch {
+						embeddings[index] = result[i]
+					}
+					done += len(batch)
+					if onProgress != nil {
+						onProgress(done)
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return embeddings, nil
+}
+
+func (s *OllamaService) embeddingCache() *EmbeddingCache {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cache
+}
+
+// embedTexts sends a single embedding request for all texts.
+func embedTexts(ctx context.Context, config ollamaConfig, texts []string) ([][]float32, error) {
+	embeddings, err := config.provider.Embed(ctx, config.embeddingModel, texts)
 	if err != nil {
-		fmt.Println(err.Error())
 		return nil, err
 	}
-	return ollamaResponse.Embeddings[0], nil // Return ollamaResponse.Message.Content
+	if len(embeddings) != len(texts) {
+		return nil, fmt.Errorf("expected %d embeddings, but got %d", len(texts), len(embeddings))
+	}
+	return embeddings, nil
 }
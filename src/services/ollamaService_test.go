@@ -0,0 +1,111 @@
+package services
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// showDelay is how long the fake Ollama takes to answer in the tests listing models.
+const showDelay = 100 * time.Millisecond
+
+func TestListModelsForConcurrentLookups(t *testing.T) {
+	capabilities := map[string][]string{"nomic-embed:latest": {"embedding"}}
+	for i := range 16 {
+		capabilities[fmt.Sprintf("llm-%d:latest", i)] = []string{"completion"}
+	}
+	backend := newFakeBackend(t, ollamaModels(capabilities))
+	backend.delay = showDelay
+	service, err := SetUpOllamaService(Settings{Provider: ProviderOllama, URL: backend.URL, LLM: "llm-0", Embedding: "nomic-embed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	models, err := service.ListModelsFor(Settings{Provider: ProviderOllama, URL: backend.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+
+	if shown := backend.modelsShown(); len(shown) != len(capabilities) {
+		t.Errorf("%d models shown, want %d", len(shown), len(capabilities))
+	}
+	// One after the other, the listing and the 17 lookups would take 18 times showDelay
+	if elapsed > 6*showDelay {
+		t.Errorf("listing took %v, the lookups don't seem to run concurrently", elapsed)
+	}
+	for _, model := range models {
+		want := []ModelCapability{CapabilityChat}
+		if strings.Contains(model.Name, "embed") {
+			want = []ModelCapability{CapabilityEmbedding}
+		}
+		if !reflect.DeepEqual(model.ReportedCapabilities, want) {
+			t.Errorf("%s reported %v, want %v", model.Name, model.ReportedCapabilities, want)
+		}
+	}
+}
+
+func TestValidateSettingsVisionModel(t *testing.T) {
+	ollama := newFakeBackend(t, ollamaModels(map[string][]string{
+		"llama:latest":       {"completion"},
+		"nomic-embed:latest": {"embedding"},
+		"llava:latest":       {"completion", "vision"},
+		"fake-vision:latest": {"completion"}, // Named like a vision model, but reported without vision
+		"old-model:latest":   nil,            // Shown by an Ollama before 0.6, which doesn't report capabilities
+	}))
+	openAI := newFakeBackend(t, map[string]fakeResponse{
+		"/v1/models": fixedResponse(`{"data":[{"id":"llama"},{"id":"nomic-embed"},{"id":"llava"},{"id":"tinyllama"}]}`),
+	})
+	service, err := SetUpOllamaService(Settings{Provider: ProviderOllama, URL: ollama.URL, LLM: "llama", Embedding: "nomic-embed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		provider    ProviderKind
+		visionModel string
+		wantShown   []string
+		wantWarning string
+		wantErr     string
+	}{
+		{name: "no vision model", provider: ProviderOllama, wantShown: nil},
+		{name: "reported vision", provider: ProviderOllama, visionModel: "llava", wantShown: []string{"llava:latest"}},
+		{name: "reported without vision", provider: ProviderOllama, visionModel: "fake-vision", wantShown: []string{"fake-vision:latest"},
+			wantErr: "does not support images"},
+		{name: "not reported by old Ollama", provider: ProviderOllama, visionModel: "old-model", wantShown: []string{"old-model:latest"},
+			wantWarning: `Ollama doesn't report whether model "old-model" supports images`},
+		{name: "missing vision model", provider: ProviderOllama, visionModel: "bakllava", wantShown: nil, wantErr: "not available"},
+		{name: "openai vision model by name", provider: ProviderOpenAI, visionModel: "llava"},
+		{name: "openai model not named like a vision model", provider: ProviderOpenAI, visionModel: "tinyllama",
+			wantWarning: `OpenAI-compatible server doesn't report whether model "tinyllama" supports images`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			url := ollama.URL
+			if test.provider == ProviderOpenAI {
+				url = openAI.URL
+			}
+			ollama.modelsShown()
+
+			warning, err := service.ValidateSettings(Settings{
+				Provider: test.provider, URL: url, LLM: "llama", Embedding: "nomic-embed", VisionModel: test.visionModel,
+			})
+			if test.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Fatalf("error = %v, want it to contain %q", err, test.wantErr)
+			}
+			if (test.wantWarning == "") != (warning == "") || !strings.Contains(warning, test.wantWarning) {
+				t.Errorf("warning = %q, want %q", warning, test.wantWarning)
+			}
+			if shown := ollama.modelsShown(); !reflect.DeepEqual(shown, test.wantShown) {
+				t.Errorf("models shown = %q, want %q", shown, test.wantShown)
+			}
+		})
+	}
+}
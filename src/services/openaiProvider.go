@@ -0,0 +1,176 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/hvossi92/gollama/src/utils"
+)
+
+// openAIProvider speaks the OpenAI-compatible API offered by llamafile, llama.cpp's server, vLLM and others.
+type openAIProvider struct {
+	chatEndpoint      string
+	embeddingEndpoint string
+	modelsEndpoint    string
+	headers           utils.Headers
+}
+
+type openAIChatRequest struct {
+	Model    string              `json:"model"`
+	Messages []openAIChatMessage `json:"messages"`
+	Stream   bool                `json:"stream"`
+}
+
+// openAIChatMessage has either a text content or, for messages with images, a list of content parts.
+type openAIChatMessage struct {
+	Role    string `json:"role"`
+	Content any    `json:"content"`
+}
+
+type openAIContentPart struct {
+	Type     string          `json:"type"`
+	Text     string          `json:"text,omitempty"`
+	ImageURL *openAIImageURL `json:"image_url,omitempty"`
+}
+
+type openAIImageURL struct {
+	URL string `json:"url"`
+}
+
+type openAIChatResponse struct {
+	Choices []struct {
+		Message ChatMessageResponse `json:"message"`
+		Delta   ChatMessageResponse `json:"delta"` // Set instead of Message while streaming
+	} `json:"choices"`
+}
+
+type openAIEmbeddingRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+type openAIEmbeddingResponse struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+}
+
+type openAIModelsResponse struct {
+	Data []struct {
+		ID string `json:"id"`
+	} `json:"data"`
+}
+
+// newOpenAIProvider creates a provider for the server at url, with or without the /v1 suffix.
+func newOpenAIProvider(url string, apiKey string) *openAIProvider {
+	url = strings.TrimSuffix(url, "/v1") + "/v1"
+	provider := &openAIProvider{
+		chatEndpoint:      url + "/chat/completions",
+		embeddingEndpoint: url + "/embeddings",
+		modelsEndpoint:    url + "/models",
+	}
+	if apiKey != "" {
+		provider.headers = utils.Headers{"Authorization": "Bearer " + apiKey}
+	}
+	return provider
+}
+
+func (p *openAIProvider) Chat(ctx context.Context, model string, messages []ChatMessage, onToken func(token string) error) (string, error) {
+	request := openAIChatRequest{
+		Model:    model,
+		Messages: make([]openAIChatMessage, len(messages)),
+		Stream:   onToken != nil,
+	}
+	for i, message := range messages {
+		request.Messages[i] = toOpenAIMessage(message)
+	}
+
+	if onToken == nil {
+		response, err := utils.SendPostRequestWithHeaders[openAIChatRequest, openAIChatResponse](ctx, p.chatEndpoint, p.headers, request)
+		if err != nil {
+			return "", err
+		}
+		if len(response.Choices) == 0 {
+			return "", fmt.Errorf("chat response has no choices")
+		}
+		return response.Choices[0].Message.Content, nil
+	}
+
+	var answer strings.Builder
+	err := utils.StreamEventsPostRequest(ctx, p.chatEndpoint, p.headers, request, func(chunk *openAIChatResponse) error {
+		if len(chunk.Choices) == 0 || chunk.Choices[0].Delta.Content == "" {
+			return nil
+		}
+		answer.WriteString(chunk.Choices[0].Delta.Content)
+		return onToken(chunk.Choices[0].Delta.Content)
+	})
+	return answer.String(), err
+}
+
+// toOpenAIMessage converts a message, whose images are sent as data URLs next to the text.
+func toOpenAIMessage(message ChatMessage) openAIChatMessage {
+	if len(message.Images) == 0 {
+		return openAIChatMessage{Role: message.Role, Content: message.Content}
+	}
+
+	parts := []openAIContentPart{{Type: "text", Text: message.Content}}
+	for _, image := range message.Images {
+		parts = append(parts, openAIContentPart{
+			Type:     "image_url",
+			ImageURL: &openAIImageURL{URL: "data:" + imageMediaType(image) + ";base64," + image},
+		})
+	}
+	return openAIChatMessage{Role: message.Role, Content: parts}
+}
+
+// imageMediaType detects the media type of a base64 encoded image.
+func imageMediaType(image string) string {
+	header, _ := base64.StdEncoding.DecodeString(image[:min(len(image), 64)])
+	return http.DetectContentType(header)
+}
+
+func (p *openAIProvider) Embed(ctx context.Context, model string, texts []string) ([][]float32, error) {
+	request := openAIEmbeddingRequest{
+		Model: model,
+		Input: texts,
+	}
+
+	response, err := utils.SendPostRequestWithHeaders[openAIEmbeddingRequest, openAIEmbeddingResponse](ctx, p.embeddingEndpoint, p.headers, request)
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Data) != len(texts) {
+		return nil, fmt.Errorf("expected %d embeddings, but got %d", len(texts), len(response.Data))
+	}
+
+	// The embeddings carry the index of their input, which is not necessarily their position
+	sort.Slice(response.Data, func(i, j int) bool { return response.Data[i].Index < response.Data[j].Index })
+	embeddings := make([][]float32, len(response.Data))
+	for i, data := range response.Data {
+		embeddings[i] = data.Embedding
+	}
+	return embeddings, nil
+}
+
+// ModelCapabilities returns nil, as the OpenAI-compatible API doesn't describe what models are capable of.
+func (p *openAIProvider) ModelCapabilities(model string) ([]ModelCapability, error) {
+	return nil, nil
+}
+
+func (p *openAIProvider) ListModels() ([]Model, error) {
+	response, err := utils.SendGetRequestWithHeaders[openAIModelsResponse](p.modelsEndpoint, p.headers)
+	if err != nil {
+		return nil, err
+	}
+
+	models := make([]Model, len(response.Data))
+	for i, data := range response.Data {
+		models[i] = Model{Name: data.ID, Model: data.ID}
+	}
+	return models, nil
+}
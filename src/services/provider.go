@@ -0,0 +1,50 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// ProviderKind selects the API an LLM backend speaks.
+type ProviderKind string
+
+const (
+	ProviderOllama ProviderKind = "ollama" // Ollama's /api endpoints
+	ProviderOpenAI ProviderKind = "openai" // OpenAI-compatible /v1 endpoints, e.g. llamafile, llama.cpp or vLLM
+)
+
+// DisplayName returns the name of the provider kind as shown to users.
+func (k ProviderKind) DisplayName() string {
+	if k == ProviderOpenAI {
+		return "OpenAI-compatible server"
+	}
+	return "Ollama"
+}
+
+// Provider is an LLM backend, which answers chats, embeds texts and lists its models.
+type Provider interface {
+	// Chat sends the messages to the model and returns its answer. If onToken is not nil, the answer is
+	// streamed and onToken is called for every chunk of it as it arrives.
+	Chat(ctx context.Context, model string, messages []ChatMessage, onToken func(token string) error) (string, error)
+	// Embed returns one embedding per text, in the order of the texts.
+	Embed(ctx context.Context, model string, texts []string) ([][]float32, error)
+	// ListModels returns the models the backend offers.
+	ListModels() ([]Model, error)
+	// ModelCapabilities returns what the backend reports a model to be capable of, or nil if it doesn't tell.
+	ModelCapabilities(model string) ([]ModelCapability, error)
+}
+
+// NewProvider creates the provider of the given kind for the backend at url. The API key is sent as bearer
+// token by OpenAI-compatible providers and may be empty for local servers.
+func NewProvider(kind ProviderKind, url string, apiKey string) (Provider, error) {
+	url = strings.TrimRight(url, "/")
+	switch kind {
+	case ProviderOllama, "":
+		return newOllamaProvider(url), nil
+	case ProviderOpenAI:
+		return newOpenAIProvider(url, apiKey), nil
+	default:
+		return nil, fmt.Errorf("unknown LLM provider %q", kind)
+	}
+}
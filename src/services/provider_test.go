@@ -0,0 +1,339 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProviderChat(t *testing.T) {
+	messages := []ChatMessage{{Role: "system", Content: "Be brief."}, {Role: "user", Content: "Hi?"}}
+
+	tests := []struct {
+		name       string
+		kind       ProviderKind
+		apiKey     string
+		stream     bool
+		path       string
+		response   string
+		wantAuth   string
+		wantTokens []string
+		want       string
+	}{
+		{
+			name:     "openai",
+			kind:     ProviderOpenAI,
+			apiKey:   "secret",
+			path:     "/v1/chat/completions",
+			response: `{"choices":[{"message":{"role":"assistant","content":"Hello!"}}]}`,
+			wantAuth: "Bearer secret",
+			want:     "Hello!",
+		},
+		{
+			name:   "openai streamed over server-sent events",
+			kind:   ProviderOpenAI,
+			apiKey: "secret",
+			stream: true,
+			path:   "/v1/chat/completions",
+			response: "data: {\"choices\":[{\"delta\":{\"role\":\"assistant\"}}]}\n\n" +
+				"data: {\"choices\":[{\"delta\":{\"content\":\"Hel\"}}]}\n\n" +
+				": keep-alive comment\n\n" +
+				"data:{\"choices\":[{\"delta\":{\"content\":\"lo!\"}}]}\n\n" +
+				"data: {\"choices\":[]}\n\n" +
+				"data: [DONE]\n\n" +
+				"data: {\"choices\":[{\"delta\":{\"content\":\" after done\"}}]}\n\n",
+			wantAuth:   "Bearer secret",
+			wantTokens: []string{"Hel", "lo!"},
+			want:       "Hello!",
+		},
+		{
+			name:     "openai without API key",
+			kind:     ProviderOpenAI,
+			path:     "/v1/chat/completions",
+			response: `{"choices":[{"message":{"role":"assistant","content":"Hello!"}}]}`,
+			want:     "Hello!",
+		},
+		{
+			name:     "ollama",
+			kind:     ProviderOllama,
+			apiKey:   "ignored",
+			path:     "/api/chat",
+			response: `{"message":{"role":"assistant","content":"Hello!"},"done":true}`,
+			want:     "Hello!",
+		},
+		{
+			name:   "ollama streamed as NDJSON",
+			kind:   ProviderOllama,
+			stream: true,
+			path:   "/api/chat",
+			response: "{\"message\":{\"role\":\"assistant\",\"content\":\"Hel\"},\"done\":false}\n\n" +
+				"{\"message\":{\"role\":\"assistant\",\"content\":\"lo!\"},\"done\":false}\n\n" +
+				"{\"message\":{\"role\":\"assistant\",\"content\":\"\"},\"done\":true}\n",
+			wantTokens: []string{"Hel", "lo!"},
+			want:       "Hello!",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := newFakeBackend(t, map[string]fakeResponse{test.path: fixedResponse(test.response)})
+			provider, err := NewProvider(test.kind, backend.URL+"/", test.apiKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var tokens []string
+			var onToken func(token string) error
+			if test.stream {
+				onToken = func(token string) error {
+					tokens = append(tokens, token)
+					return nil
+				}
+			}
+			answer, err := provider.Chat(context.Background(), "test-llm", messages, onToken)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if answer != test.want {
+				t.Errorf("answer = %q, want %q", answer, test.want)
+			}
+			if !reflect.DeepEqual(tokens, test.wantTokens) {
+				t.Errorf("tokens = %q, want %q", tokens, test.wantTokens)
+			}
+
+			request := backend.lastRequest(t)
+			if request.Method != http.MethodPost || request.Path != test.path {
+				t.Errorf("request = %s %s, want POST %s", request.Method, request.Path, test.path)
+			}
+			if request.Authorization != test.wantAuth {
+				t.Errorf("Authorization = %q, want %q", request.Authorization, test.wantAuth)
+			}
+			var body struct {
+				Model    string        `json:"model"`
+				Messages []ChatMessage `json:"messages"`
+				Stream   bool          `json:"stream"`
+			}
+			if err := json.Unmarshal([]byte(request.Body), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Model != "test-llm" || body.Stream != test.stream || !reflect.DeepEqual(body.Messages, messages) {
+				t.Errorf("request body = %s", request.Body)
+			}
+		})
+	}
+}
+
+func TestProviderChatError(t *testing.T) {
+	for _, kind := range []ProviderKind{ProviderOllama, ProviderOpenAI} {
+		for _, stream := range []bool{false, true} {
+			backend := newFakeBackend(t, nil)
+			provider, err := NewProvider(kind, backend.URL, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var onToken func(token string) error
+			if stream {
+				onToken = func(token string) error { return nil }
+			}
+			_, err = provider.Chat(context.Background(), "test-llm", nil, onToken)
+			if err == nil || !strings.Contains(err.Error(), "404") {
+				t.Errorf("%s (stream %v): error = %v, want the HTTP error", kind, stream, err)
+			}
+		}
+	}
+}
+
+func TestOpenAIChatImages(t *testing.T) {
+	png := "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNk+M9QDwADhgGAWjR9awAAAABJRU5ErkJggg=="
+	message := toOpenAIMessage(ChatMessage{Role: "user", Content: "What is this?", Images: []string{png}})
+
+	want := []openAIContentPart{
+		{Type: "text", Text: "What is this?"},
+		{Type: "image_url", ImageURL: &openAIImageURL{URL: "data:image/png;base64," + png}},
+	}
+	if !reflect.DeepEqual(message.Content, want) {
+		t.Errorf("content = %+v, want %+v", message.Content, want)
+	}
+}
+
+func TestProviderEmbed(t *testing.T) {
+	texts := []string{"first", "second", "third"}
+
+	tests := []struct {
+		name     string
+		kind     ProviderKind
+		apiKey   string
+		path     string
+		response string
+		wantAuth string
+		want     [][]float32
+		wantErr  string
+	}{
+		{
+			name:     "openai sorted by index",
+			kind:     ProviderOpenAI,
+			apiKey:   "secret",
+			path:     "/v1/embeddings",
+			response: `{"data":[{"index":2,"embedding":[3,3]},{"index":0,"embedding":[1,1]},{"index":1,"embedding":[2,2]}]}`,
+			wantAuth: "Bearer secret",
+			want:     [][]float32{{1, 1}, {2, 2}, {3, 3}},
+		},
+		{
+			name:     "openai missing embeddings",
+			kind:     ProviderOpenAI,
+			path:     "/v1/embeddings",
+			response: `{"data":[{"index":0,"embedding":[1,1]}]}`,
+			wantErr:  "expected 3 embeddings, but got 1",
+		},
+		{
+			name:     "ollama",
+			kind:     ProviderOllama,
+			path:     "/api/embed",
+			response: `{"model":"test-embedding","embeddings":[[1,1],[2,2],[3,3]]}`,
+			want:     [][]float32{{1, 1}, {2, 2}, {3, 3}},
+		},
+		{
+			name:     "ollama missing embeddings",
+			kind:     ProviderOllama,
+			path:     "/api/embed",
+			response: `{"model":"test-embedding","embeddings":[]}`,
+			wantErr:  "expected 3 embeddings, but got 0",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := newFakeBackend(t, map[string]fakeResponse{test.path: fixedResponse(test.response)})
+			provider, err := NewProvider(test.kind, backend.URL, test.apiKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			embeddings, err := provider.Embed(context.Background(), "test-embedding", texts)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("error = %v, want it to contain %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(embeddings, test.want) {
+				t.Errorf("embeddings = %v, want %v", embeddings, test.want)
+			}
+
+			request := backend.lastRequest(t)
+			if request.Path != test.path || request.Authorization != test.wantAuth {
+				t.Errorf("request to %s with Authorization %q, want %s with %q", request.Path, request.Authorization, test.path, test.wantAuth)
+			}
+			var body EmbeddingRequest
+			if err := json.Unmarshal([]byte(request.Body), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Model != "test-embedding" || !reflect.DeepEqual(body.Input, texts) {
+				t.Errorf("request body = %s", request.Body)
+			}
+		})
+	}
+}
+
+func TestProviderListModels(t *testing.T) {
+	tests := []struct {
+		name     string
+		kind     ProviderKind
+		apiKey   string
+		url      string // Appended to the backend URL
+		path     string
+		response string
+		wantAuth string
+		want     []string
+	}{
+		{
+			name:     "openai",
+			kind:     ProviderOpenAI,
+			apiKey:   "secret",
+			path:     "/v1/models",
+			response: `{"data":[{"id":"llama"},{"id":"nomic-embed"}]}`,
+			wantAuth: "Bearer secret",
+			want:     []string{"llama", "nomic-embed"},
+		},
+		{
+			name:     "openai URL with /v1",
+			kind:     ProviderOpenAI,
+			url:      "/v1/",
+			path:     "/v1/models",
+			response: `{"data":[{"id":"llama"}]}`,
+			want:     []string{"llama"},
+		},
+		{
+			name:     "ollama",
+			kind:     ProviderOllama,
+			apiKey:   "ignored",
+			path:     "/api/tags",
+			response: `{"models":[{"name":"llama:latest","model":"llama:latest"},{"name":"nomic-embed:latest","model":"nomic-embed:latest"}]}`,
+			want:     []string{"llama:latest", "nomic-embed:latest"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := newFakeBackend(t, map[string]fakeResponse{test.path: fixedResponse(test.response)})
+			provider, err := NewProvider(test.kind, backend.URL+test.url, test.apiKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			models, err := provider.ListModels()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, model := range models {
+				names = append(names, model.Name)
+			}
+			if !reflect.DeepEqual(names, test.want) {
+				t.Errorf("models = %q, want %q", names, test.want)
+			}
+
+			request := backend.lastRequest(t)
+			if request.Method != http.MethodGet || request.Path != test.path || request.Authorization != test.wantAuth {
+				t.Errorf("request = %s %s with Authorization %q, want GET %s with %q",
+					request.Method, request.Path, request.Authorization, test.path, test.wantAuth)
+			}
+		})
+	}
+}
+
+func TestProviderModelCapabilities(t *testing.T) {
+	backend := newFakeBackend(t, map[string]fakeResponse{
+		"/api/show": fixedResponse(`{"capabilities":["completion","vision","tools"]}`),
+	})
+
+	ollama, err := NewProvider(ProviderOllama, backend.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	capabilities, err := ollama.ModelCapabilities("llava")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []ModelCapability{CapabilityChat, CapabilityVision}; !reflect.DeepEqual(capabilities, want) {
+		t.Errorf("capabilities = %v, want %v", capabilities, want)
+	}
+	if request := backend.lastRequest(t); request.Path != "/api/show" || !strings.Contains(request.Body, `"llava"`) {
+		t.Errorf("request = %+v, want the model shown", request)
+	}
+
+	openAI, err := NewProvider(ProviderOpenAI, backend.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if capabilities, err := openAI.ModelCapabilities("llava"); err != nil || capabilities != nil {
+		t.Errorf("capabilities = %v (%v), want none reported", capabilities, err)
+	}
+}
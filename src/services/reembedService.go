@@ -0,0 +1,158 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// reembedSliceSize is the number of chunks embedded and staged at a time while re-embedding.
+const reembedSliceSize = 256
+
+// ReembedStatus is a snapshot of the progress of a re-embedding run.
+type ReembedStatus struct {
+	Running  bool
+	Finished bool
+	Model    string
+	Done     int
+	Total    int
+	Error    string
+}
+
+// Percent returns the progress of the run in percent.
+func (s ReembedStatus) Percent() int {
+	if s.Total == 0 {
+		return 0
+	}
+	return s.Done * 100 / s.Total
+}
+
+// ReembedService rebuilds the vectors table with embeddings of the configured embedding model,
+// after the embedding model was changed in the settings.
+type ReembedService struct {
+	mu            sync.Mutex
+	status        ReembedStatus
+	vectorService *VectorService
+	ollamaService *OllamaService
+}
+
+func SetUpReembedService(vectorService *VectorService, ollamaService *OllamaService) *ReembedService {
+	return &ReembedService{vectorService: vectorService, ollamaService: ollamaService}
+}
+
+// Status returns the progress of the current or last run.
+func (s *ReembedService) Status() ReembedStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+// Start re-embeds all stored chunks with the configured embedding model in the background.
+func (s *ReembedService) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.status.Running {
+		return fmt.Errorf("re-embedding with %s is already running", s.status.Model)
+	}
+
+	s.status = ReembedStatus{Running: true, Model: s.ollamaService.EmbeddingModel()}
+	go s.run(s.status.Model)
+	return nil
+}
+
+func (s *ReembedService) run(model string) {
+	err := s.reembed(model)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Running = false
+	s.status.Finished = true
+	if err != nil {
+		log.Printf("Re-embedding with %s failed: %v\n", model, err)
+		s.status.Error = err.Error()
+	}
+}
+
+// reembedAttempts bounds how often chunks stored while re-embedding are embedded before giving up.
+const reembedAttempts = 3
+
+func (s *ReembedService) reembed(model string) error {
+	ids, texts, err := s.vectorService.listChunks()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.status.Total = len(ids)
+	s.mu.Unlock()
+
+	dimension := 0
+	for attempt := 1; ; attempt++ {
+		dimension, err = s.stage(model, ids, texts, dimension)
+		if err != nil {
+			return err
+		}
+		if dimension == 0 {
+			return nil // Nothing to re-embed
+		}
+
+		// Chunks stored in the meantime have no staged embedding yet, they are embedded in another round
+		err = s.vectorService.finishReembedding(EmbeddingInfo{Model: model, Dimension: dimension})
+		if !errors.Is(err, errChunksNotStaged) || attempt == reembedAttempts {
+			return err
+		}
+		ids, texts, err = s.vectorService.listChunksWhere("id NOT IN (SELECT id FROM vectors_reembed)")
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.status.Total += len(ids)
+		s.mu.Unlock()
+	}
+}
+
+// stage embeds chunks and stores their embeddings in the staging table, which is created with the dimension of
+// the first embedding if dimension is 0. It returns the dimension of the staged embeddings.
+func (s *ReembedService) stage(model string, ids []int64, texts []string, dimension int) (int, error) {
+	s.mu.Lock()
+	staged := s.status.Done
+	s.mu.Unlock()
+
+	// Embed in slices, so a changed embedding model is noticed early and progress is staged as it goes
+	for start := 0; start < len(texts); start += reembedSliceSize {
+		end := min(start+reembedSliceSize, len(texts))
+		if current := s.ollamaService.EmbeddingModel(); current != model {
+			return 0, fmt.Errorf("embedding model changed to %s while re-embedding", current)
+		}
+
+		embeddings, err := s.ollamaService.EmbedBatch(context.Background(), texts[start:end], func(done int) {
+			s.mu.Lock()
+			s.status.Done = staged + start + done
+			s.mu.Unlock()
+		})
+		if err != nil {
+			return 0, err
+		}
+
+		// The first embedding determines the dimension of the new table
+		if dimension == 0 {
+			dimension = len(embeddings[0])
+			if err := s.vectorService.beginReembedding(dimension); err != nil {
+				return 0, err
+			}
+		}
+		for i, embedding := range embeddings {
+			if len(embedding) != dimension {
+				return 0, fmt.Errorf("%s returned %d instead of %d dimensions for chunk %d", model, len(embedding), dimension, ids[start+i])
+			}
+		}
+
+		if err := s.vectorService.stageReembedding(ids[start:end], embeddings); err != nil {
+			return 0, err
+		}
+	}
+	return dimension, nil
+}
@@ -0,0 +1,51 @@
+package services
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFinishReembedding(t *testing.T) {
+	s := newTestVectorService(t)
+	ingestTestDocument(t, s, fakeOllamaEmbed(t), "Test", "One. Two. Three.")
+	ids, _, err := s.listChunks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A chunk stored while re-embedding has no staged embedding
+	if err := s.beginReembedding(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.stageReembedding(ids[:2], [][]float32{{1, 0}, {0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	err = s.finishReembedding(EmbeddingInfo{Model: "new-model", Dimension: 2})
+	if !errors.Is(err, errChunksNotStaged) {
+		t.Fatalf("error = %v, want %v", err, errChunksNotStaged)
+	}
+	if info, err := s.GetEmbeddingInfo(); err != nil || info.Dimension != 3 {
+		t.Fatalf("embedding info = %+v (%v), want the old 3 dimensions kept", info, err)
+	}
+
+	// Once it is staged as well, the table is replaced and the full-text index loses deleted chunks
+	if err := s.stageReembedding(ids[2:], [][]float32{{1, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.db.Exec("INSERT INTO vectors_fts (rowid, text) VALUES (?, 'deleted chunk')", ids[2]+1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.finishReembedding(EmbeddingInfo{Model: "new-model", Dimension: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := s.GetEmbeddingInfo(); err != nil || info.Dimension != 2 || info.Model != "new-model" {
+		t.Errorf("embedding info = %+v (%v), want 2 dimensions of new-model", info, err)
+	}
+	if kept, _, err := s.listChunks(); err != nil || len(kept) != len(ids) {
+		t.Errorf("%d chunks kept (%v), want %d", len(kept), err, len(ids))
+	}
+	var indexed int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM vectors_fts").Scan(&indexed); err != nil || indexed != len(ids) {
+		t.Errorf("%d chunks in the full-text index (%v), want %d", indexed, err, len(ids))
+	}
+}
@@ -0,0 +1,90 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// streamHandleTTL is how long a stream handle waits for the browser to connect before it is dropped.
+const streamHandleTTL = 5 * time.Minute
+
+// ChatStream is a pending chat question, waiting for the browser to open its event stream.
+type ChatStream struct {
+	ID             string
+	Question       string
+	UseRag         bool
+	Retrieval      RetrievalOptions
+	ConversationID int64
+	History        []ChatMessage
+	createdAt      time.Time
+}
+
+// StreamService hands out stream handles for chat questions, which are answered once the
+// browser connects to the matching Server-Sent Events endpoint.
+type StreamService struct {
+	mu      sync.Mutex
+	streams map[string]*ChatStream
+}
+
+func SetUpStreamService() *StreamService {
+	return &StreamService{streams: make(map[string]*ChatStream)}
+}
+
+// Create registers a new chat question of a conversation and returns its stream handle.
+func (s *StreamService) Create(question string, useRag bool, retrieval RetrievalOptions, conversationID int64, history []ChatMessage) (*ChatStream, error) {
+	id, err := newRandomID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stream id: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Drop handles that were never connected to
+	for streamID, stream := range s.streams {
+		if time.Since(stream.createdAt) > streamHandleTTL {
+			delete(s.streams, streamID)
+		}
+	}
+
+	stream := &ChatStream{
+		ID:             id,
+		Question:       question,
+		UseRag:         useRag,
+		Retrieval:      retrieval,
+		ConversationID: conversationID,
+		History:        history,
+		createdAt:      time.Now(),
+	}
+	s.streams[id] = stream
+	return stream, nil
+}
+
+// Take removes the stream handle with the given id and returns it. A handle can only be taken once,
+// so a reconnecting browser does not trigger a second answer, and not after streamHandleTTL.
+func (s *StreamService) Take(id string) (*ChatStream, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stream, ok := s.streams[id]
+	if !ok {
+		return nil, false
+	}
+	delete(s.streams, id)
+	if time.Since(stream.createdAt) > streamHandleTTL {
+		return nil, false
+	}
+	return stream, true
+}
+
+// newRandomID returns a random, unguessable hex id.
+func newRandomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
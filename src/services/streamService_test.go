@@ -0,0 +1,36 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStreamServiceTake(t *testing.T) {
+	tests := []struct {
+		name string
+		age  time.Duration
+		want bool
+	}{
+		{name: "fresh handle", age: 0, want: true},
+		{name: "handle about to expire", age: streamHandleTTL - time.Minute, want: true},
+		{name: "expired handle", age: streamHandleTTL + time.Second, want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service := SetUpStreamService()
+			stream, err := service.Create("Hi?", false, RetrievalOptions{}, 1, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stream.createdAt = time.Now().Add(-test.age)
+
+			if _, ok := service.Take(stream.ID); ok != test.want {
+				t.Errorf("first Take = %v, want %v", ok, test.want)
+			}
+			if _, ok := service.Take(stream.ID); ok {
+				t.Error("second Take returned the handle again")
+			}
+		})
+	}
+}
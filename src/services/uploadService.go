@@ -1,103 +1,290 @@
 package services
 
 import (
+	"errors"
+	"fmt"
 	"html/template"
 	"io"
+	"log"
 	"mime/multipart"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 )
 
-type FileUrl struct {
-	FileURL string
+// sessionCookie identifies the browser session that uploaded images belong to.
+const sessionCookie = "gollama_session"
+
+// uploadsDir holds the uploaded images. It is emptied at every start.
+const uploadsDir = "./uploads"
+
+// defaultImageQuestion is asked about an image if the user submits the annotations without a question.
+const defaultImageQuestion = "I am giving you annotation data for the provided image, denoting rectangular areas of the image. x, y, w and h are pixels of the original image, so a box starts at x pixels from the left and y pixels from the top. It is w pixels wide and h pixels high. Explain what you see in the boxes, considering the marked areas."
+
+// transcriptionQuestion asks the vision model for the text in an image, to add it to the vector database.
+const transcriptionQuestion = "Transcribe all text in the image, or in the marked areas if there are any, exactly as it is written. " +
+	"Keep the reading order, and keep headings, lists and tables as Markdown. Don't translate, summarize, correct or explain " +
+	"anything, and don't add text of your own. If there is no text, answer only with " + noTextAnswer + "."
+
+// noTextAnswer is the answer to transcriptionQuestion for images without text.
+const noTextAnswer = "NO TEXT"
+
+// DefaultMaxImageSize is the size limit of uploaded images in MB, until it is changed with SetMaxImageSize.
+const DefaultMaxImageSize = 10
+
+// UploadedImage is an image uploaded by a browser session. It is only visible to that session.
+type UploadedImage struct {
+	ID        string
+	SessionID string
+	Filename  string // Name of the file on the client, only shown to the user
+	MediaType string
+	Size      int // In bytes
+	Width     int
+	Height    int
+	Path      string // Location of the stored file, named after the ID
+	FileURL   string
+	History   []ChatMessage // Questions about the image and their answers, continued by follow-up questions
 }
 
-// VectorDBService represents the service responsible for the vector database.
+// UploadService stores uploaded images and asks the vision model about them.
 type UploadService struct {
 	templates     *template.Template
-	fileURL       string
-	filename      string
+	vectorService *VectorService
 	ollamaService *OllamaService
+	jobService    *JobService
+
+	mu      sync.Mutex
+	images  map[string]*UploadedImage // Uploaded images by ID
+	maxSize int64                     // In bytes
+}
+
+func SetUploadService(templates *template.Template, vectorService *VectorService, ollamaService *OllamaService, jobService *JobService) *UploadService {
+	return &UploadService{
+		templates:     templates,
+		vectorService: vectorService,
+		ollamaService: ollamaService,
+		jobService:    jobService,
+		images:        make(map[string]*UploadedImage),
+		maxSize:       DefaultMaxImageSize << 20,
+	}
+}
+
+// sessionID returns the session of the browser, starting a new one with a cookie if it has none yet.
+func sessionID(w http.ResponseWriter, r *http.Request) (string, error) {
+	if cookie, err := r.Cookie(sessionCookie); err == nil && cookie.Value != "" {
+		return cookie.Value, nil
+	}
+
+	id, err := newRandomID()
+	if err != nil {
+		return "", fmt.Errorf("failed to create session id: %w", err)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return id, nil
 }
 
-func SetUploadService(templates *template.Template, ollamaService *OllamaService) *UploadService {
-	return &UploadService{templates: templates, ollamaService: ollamaService}
+// RequestSession returns the session of the browser that sent the request, or an empty string if it has none.
+func RequestSession(r *http.Request) string {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// image returns the uploaded image with the given ID, if it belongs to the session of the request.
+func (s *UploadService) image(r *http.Request, id string) (*UploadedImage, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	image, ok := s.images[id]
+	if !ok || image.SessionID != cookie.Value {
+		return nil, false
+	}
+	return image, true
 }
 
+// UploadAndSaveImage stores an uploaded image, if it is a JPG, PNG or GIF image within the size
+// limit, and shows it for annotation. Rejected uploads are answered with an alert.
 func (s *UploadService) UploadAndSaveImage(w http.ResponseWriter, r *http.Request) {
-	file, header, err := s.handleFileUpload(r)
+	session, err := sessionID(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data, header, err := s.readUpload(w, r)
+	if err != nil {
+		s.renderAlert(w, "danger", "Image not uploaded: "+err.Error())
+		return
+	}
+	info, err := inspectImage(data)
+	if err != nil {
+		s.renderAlert(w, "danger", "Image not uploaded: "+err.Error())
+		return
+	}
+
+	image, err := s.saveImage(session, data, header, info)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	err = s.saveImage(w, r, file, header)
+
+	// Respond with HTMX to update the image area
+	err = s.templates.ExecuteTemplate(w, "image-display.html", image) // Use pre-parsed template
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
-func (s *UploadService) handleFileUpload(r *http.Request) (multipart.File, *multipart.FileHeader, error) {
-	// Parse multipart form, limit memory usage for file uploads
-	err := r.ParseMultipartForm(10 << 20) // 10 MB limit
+// readUpload returns the content of the uploaded file, unless it exceeds the size limit.
+func (s *UploadService) readUpload(w http.ResponseWriter, r *http.Request) ([]byte, *multipart.FileHeader, error) {
+	maxSize := s.maxImageSize()
+	tooLarge := fmt.Errorf("the image is larger than %d MB", maxSize>>20)
+
+	// Leave some room for the rest of the multipart form
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+1<<20)
+	err := r.ParseMultipartForm(10 << 20) // Larger files are buffered on disk
+	var maxBytesError *http.MaxBytesError
+	if errors.As(err, &maxBytesError) {
+		return nil, nil, tooLarge
+	}
 	if err != nil {
 		return nil, nil, err
 	}
 
-	file, header, err := r.FormFile("file") // "image" is the name attribute in your HTML input
+	file, header, err := r.FormFile("file")
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, fmt.Errorf("no image was provided")
 	}
 	defer file.Close()
+	if header.Size > maxSize {
+		return nil, nil, tooLarge
+	}
 
-	// Ensure "uploads" directory exists
-	err = os.MkdirAll("./uploads", os.ModePerm)
+	data, err := io.ReadAll(file)
 	if err != nil {
 		return nil, nil, err
 	}
-
-	return file, header, nil
+	return data, header, nil
 }
 
-func (s *UploadService) saveImage(w http.ResponseWriter, r *http.Request, file multipart.File, header *multipart.FileHeader) error {
-	// Create a unique filename (you might want to use UUIDs or timestamps for better uniqueness)
-	s.filename = filepath.Join("./uploads", header.Filename) // Or generate a unique name
-	outFile, err := os.Create(s.filename)
+// saveImage stores the image under a generated name and registers it for the session.
+func (s *UploadService) saveImage(session string, data []byte, header *multipart.FileHeader, info imageInfo) (*UploadedImage, error) {
+	// The client's filename is neither unique nor safe to use as path, so the file is named after a random ID
+	id, err := newRandomID()
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to create image id: %w", err)
+	}
+	image := &UploadedImage{
+		ID:        id,
+		SessionID: session,
+		Filename:  cleanFilename(header.Filename),
+		MediaType: info.MediaType,
+		Size:      len(data),
+		Width:     info.Width,
+		Height:    info.Height,
+		Path:      filepath.Join(uploadsDir, id+imageExtensions[info.MediaType]),
+		FileURL:   "/uploads/" + id,
 	}
-	defer outFile.Close()
 
-	_, err = io.Copy(outFile, file)
+	err = os.MkdirAll(uploadsDir, 0o750)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to create uploads directory: %w", err)
+	}
+	err = os.WriteFile(image.Path, data, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store image: %w", err)
 	}
 
-	// Respond with HTMX to update the image area
-	s.fileURL = "/uploads/" + header.Filename // URL to access the uploaded image
+	s.mu.Lock()
+	s.images[id] = image
+	s.mu.Unlock()
+	return image, nil
+}
 
-	data := FileUrl{FileURL: s.fileURL}
-	err = s.templates.ExecuteTemplate(w, "image-display.html", data) // Use pre-parsed template
+// cleanFilename reduces a client's filename, which may be a Windows path, to its base name.
+func cleanFilename(name string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == "/" {
+		return "image"
+	}
+	return name
+}
+
+// SetMaxImageSize limits the size of uploaded images in MB.
+func (s *UploadService) SetMaxImageSize(megabytes int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxSize = int64(max(megabytes, 1)) << 20
+}
+
+func (s *UploadService) maxImageSize() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.maxSize
+}
+
+func (s *UploadService) renderAlert(w http.ResponseWriter, level string, message string) {
+	data := struct {
+		Level   string
+		Message string
+	}{
+		Level:   level,
+		Message: message,
+	}
+	err := s.templates.ExecuteTemplate(w, "alert.html", data)
 	if err != nil {
-		return err
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// ServeImage sends an uploaded image to the session that uploaded it.
+func (s *UploadService) ServeImage(w http.ResponseWriter, r *http.Request) {
+	image, ok := s.image(r, r.PathValue("id"))
+	if !ok {
+		http.NotFound(w, r)
+		return
 	}
-	return nil
+	http.ServeFile(w, r, image.Path)
 }
 
 // Handler to serve the annotation UI fragment (buttons, canvas, etc.)
 func (s *UploadService) AnnotationUIHandler(w http.ResponseWriter, r *http.Request) {
-	data := FileUrl{FileURL: s.fileURL}
-	err := s.templates.ExecuteTemplate(w, "annotation-ui.html", data) // Use pre-parsed template
+	image, ok := s.image(r, r.PathValue("id"))
+	if !ok {
+		http.Error(w, "Image not found, please upload it again", http.StatusNotFound)
+		return
+	}
+
+	err := s.templates.ExecuteTemplate(w, "annotation-ui.html", image) // Use pre-parsed template
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
+// SubmitAnnotationsHandler asks the vision model the user's question about an image and its marked areas.
+// Earlier questions about the same image are replayed, so follow-up questions continue the conversation.
+// The answer is kept as image analysis and, if requested, added to the vector database.
 func (s *UploadService) SubmitAnnotationsHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	image, ok := s.image(r, r.PathValue("id"))
+	if !ok {
+		http.Error(w, "Image not found, please upload it again", http.StatusNotFound)
 		return
 	}
 
@@ -107,18 +294,53 @@ func (s *UploadService) SubmitAnnotationsHandler(w http.ResponseWriter, r *http.
 		return
 	}
 
-	annotationData := r.Form.Get("annotations") // Get the JSON string from hx-vals
+	// The rectangles are drawn on the image as displayed, which is usually scaled down
+	displayWidth, _ := strconv.ParseFloat(r.Form.Get("display_width"), 64)
+	displayHeight, _ := strconv.ParseFloat(r.Form.Get("display_height"), 64)
+	annotations, err := parseAnnotations(r.Form.Get("annotations"), displayWidth, displayHeight, image.Width, image.Height)
+	if err != nil {
+		s.renderAlert(w, "danger", "Invalid annotations: "+err.Error())
+		return
+	}
+	mode := ParseImageMode(r.Form.Get("image_mode"))
+	message := strings.TrimSpace(r.Form.Get("question"))
+	if message == "" {
+		message = defaultImageQuestion
+	}
 
-	message := "I am giving you annotation data for the provided image, denoting a rectangular area of the image. x, y, w, h and are pixel, so the box starts at x pixels from the left and y pixels from the top. It is w pixels wide and h pixels high. Explain what you see in the box, considering the marked areas."
-	aiResponse, err := s.ollamaService.SendImageToOllama(message, s.filename, annotationData)
+	settings, err := s.vectorService.GetSettings()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	s.mu.Lock()
+	history := trimHistory(image.History, settings.HistoryTurns, settings.HistoryTokens)
+	s.mu.Unlock()
+
+	aiResponse, err := s.ollamaService.SendImageToOllama(message, image.Path, annotations, mode, history)
+	if err != nil {
+		s.renderAlert(w, "danger", "Image analysis failed: "+err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	image.History = append(image.History,
+		ChatMessage{Role: "user", Content: imageQuestion(message, annotations)},
+		ChatMessage{Role: "assistant", Content: aiResponse})
+	s.mu.Unlock()
+
+	// Keep the analysis, but still show the answer if that fails
+	analysis, err := s.saveAnalysis(image, annotations, message, aiResponse)
+	if err != nil {
+		log.Printf("Failed to store the analysis of %s: %v\n", image.Path, err)
+	} else {
+		w.Header().Set("HX-Trigger", "image-analysis-saved") // Refreshes the gallery
+	}
 
 	data := struct {
 		UserMessage string
 		AIResponse  string
+		Citations   []Citation
 	}{
 		UserMessage: message,
 		AIResponse:  aiResponse,
@@ -128,6 +350,100 @@ func (s *UploadService) SubmitAnnotationsHandler(w http.ResponseWriter, r *http.
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+
+	if analysis != nil && r.Form.Get("add_to_knowledge_base") == "on" {
+		job, err := s.jobService.SubmitImageAnalysis(analysis)
+		if err != nil {
+			s.renderAlert(w, "danger", "Adding the analysis to the vector database failed: "+err.Error())
+			return
+		}
+		err = s.templates.ExecuteTemplate(w, "job.html", job)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// saveAnalysis stores an answer about an image together with a thumbnail of the image.
+func (s *UploadService) saveAnalysis(image *UploadedImage, annotations ImageMetadata, question string, answer string) (*ImageAnalysis, error) {
+	thumbnail, err := makeThumbnail(image.Path, annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	analysis := &ImageAnalysis{
+		ImageID:     image.ID,
+		SessionID:   image.SessionID,
+		Filename:    image.Filename,
+		Annotations: annotations,
+		Question:    question,
+		Model:       s.ollamaService.VisionModel(),
+		Answer:      answer,
+	}
+	if err := s.vectorService.CreateImageAnalysis(analysis, thumbnail); err != nil {
+		return nil, err
+	}
+	return analysis, nil
+}
+
+// TranscribeImageHandler has the vision model transcribe the text in an image, or in its marked areas, and
+// adds the transcription to the vector database as a document named after the image.
+func (s *UploadService) TranscribeImageHandler(w http.ResponseWriter, r *http.Request) {
+	image, ok := s.image(r, r.PathValue("id"))
+	if !ok {
+		http.Error(w, "Image not found, please upload it again", http.StatusNotFound)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Error parsing form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	displayWidth, _ := strconv.ParseFloat(r.Form.Get("display_width"), 64)
+	displayHeight, _ := strconv.ParseFloat(r.Form.Get("display_height"), 64)
+	annotations, err := parseAnnotations(r.Form.Get("annotations"), displayWidth, displayHeight, image.Width, image.Height)
+	if err != nil {
+		s.renderAlert(w, "danger", "Invalid annotations: "+err.Error())
+		return
+	}
+
+	// Cropped areas are read best, and earlier questions about the image would only distract from the text
+	transcription, err := s.ollamaService.SendImageToOllama(transcriptionQuestion, image.Path, annotations, ImageModeCrop, nil)
+	if err != nil {
+		s.renderAlert(w, "danger", "Text extraction failed: "+err.Error())
+		return
+	}
+	transcription = strings.TrimSpace(transcription)
+	if transcription == "" || strings.Trim(transcription, ".* ") == noTextAnswer {
+		s.renderAlert(w, "warning", "No text was found in "+image.Filename)
+		return
+	}
+
+	job, err := s.jobService.SubmitIngestion(image.Filename, "image", transcription, DefaultChunkOptions(ChunkMarkdown))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		UserMessage string
+		AIResponse  string
+		Citations   []Citation
+	}{
+		UserMessage: "Extract the text of " + image.Filename,
+		AIResponse:  transcription,
+	}
+	err = s.templates.ExecuteTemplate(w, "message.html", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = s.templates.ExecuteTemplate(w, "job.html", job)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
 }
 
 func (s *UploadService) CancelAnnotationHandler(w http.ResponseWriter, r *http.Request) {
@@ -135,13 +451,27 @@ func (s *UploadService) CancelAnnotationHandler(w http.ResponseWriter, r *http.R
 	w.Write([]byte("<p>Annotation cancelled.</p>"))
 }
 
+// PruneUploads deletes the images uploaded by the session of the request. Other sessions keep theirs.
 func (s *UploadService) PruneUploads(w http.ResponseWriter, r *http.Request) {
-	// Delete all files in the uploads directory
-	err := os.RemoveAll("./uploads")
+	cookie, err := r.Cookie(sessionCookie)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		w.Write([]byte("No uploads to prune"))
 		return
 	}
-	// write 'All uploads pruned' to the response
-	w.Write([]byte("All uploads pruned"))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pruned := 0
+	for id, image := range s.images {
+		if image.SessionID != cookie.Value {
+			continue
+		}
+		if err := os.Remove(image.Path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to delete upload %s: %v\n", image.Path, err)
+			continue
+		}
+		delete(s.images, id)
+		pruned++
+	}
+	fmt.Fprintf(w, "%d uploads pruned", pruned)
 }
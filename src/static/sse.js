@@ -0,0 +1,61 @@
+/*
+ * Minimal Server-Sent Events extension for htmx 2.
+ *
+ * Supports the attributes of the official htmx sse extension that Gollama uses:
+ *   sse-connect="<url>"  opens an EventSource on the element
+ *   sse-swap="a,b"       swaps the data of the named events into the element (honours hx-swap)
+ *   sse-close="<event>"  closes the EventSource once the named event arrives
+ */
+(function () {
+    let api;
+
+    function connect(elt) {
+        const url = elt.getAttribute('sse-connect');
+        if (!url || elt.sseEventSource) return;
+
+        const source = new EventSource(url);
+        elt.sseEventSource = source;
+
+        const targets = Array.from(elt.querySelectorAll('[sse-swap]'));
+        if (elt.hasAttribute('sse-swap')) targets.push(elt);
+        targets.forEach(target => listen(source, target));
+
+        const closeEvent = elt.getAttribute('sse-close');
+        if (closeEvent) {
+            source.addEventListener(closeEvent, () => close(elt));
+        }
+
+        source.onerror = () => {
+            // The browser only gives up on its own for fatal errors (e.g. a 404 for an expired stream)
+            if (source.readyState === EventSource.CLOSED) close(elt);
+        };
+    }
+
+    function listen(source, target) {
+        target.getAttribute('sse-swap').split(',').forEach(name => {
+            source.addEventListener(name.trim(), event => {
+                htmx.swap(target, event.data, api.getSwapSpecification(target));
+            });
+        });
+    }
+
+    function close(elt) {
+        if (!elt.sseEventSource) return;
+        elt.sseEventSource.close();
+        delete elt.sseEventSource;
+        htmx.trigger(elt, 'htmx:sseClose');
+    }
+
+    htmx.defineExtension('sse', {
+        init: function (internalAPI) {
+            api = internalAPI;
+        },
+        onEvent: function (name, evt) {
+            if (name === 'htmx:afterProcessNode') {
+                connect(evt.target);
+            } else if (name === 'htmx:beforeCleanupElement') {
+                close(evt.target);
+            }
+        }
+    });
+})();
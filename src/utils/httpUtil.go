@@ -1,16 +1,40 @@
 package utils
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
+	"time"
 )
 
+// getClient is used for GET requests, which only query metadata and should fail fast if the server is unreachable.
+var getClient = &http.Client{Timeout: 10 * time.Second}
+
+// Headers are additional HTTP headers of a request, e.g. an Authorization header.
+type Headers map[string]string
+
 func SendGetRequest[RespBodyType any](url string) (*RespBodyType, error) {
-	// Perform the HTTP POST request
-	response, err := http.Get(url)
+	return SendGetRequestWithHeaders[RespBodyType](url, nil)
+}
+
+// SendGetRequestWithHeaders works like SendGetRequest, but sends additional headers.
+func SendGetRequestWithHeaders[RespBodyType any](url string, headers Headers) (*RespBodyType, error) {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+
+	// Perform the HTTP GET request
+	response, err := getClient.Do(request)
 	if err != nil {
 		return nil, fmt.Errorf("http GET request failed: %w", err)
 	}
@@ -25,12 +49,17 @@ func SendGetRequest[RespBodyType any](url string) (*RespBodyType, error) {
 }
 
 func SendPostRequest[ReqBodyType, RespBodyType any](url string, requestBody ReqBodyType) (*RespBodyType, error) {
-	payload, err := json.Marshal(requestBody)
+	return SendPostRequestWithHeaders[ReqBodyType, RespBodyType](context.Background(), url, nil, requestBody)
+}
+
+// SendPostRequestWithHeaders works like SendPostRequest, but sends additional headers and gives up once ctx is cancelled.
+func SendPostRequestWithHeaders[ReqBodyType, RespBodyType any](ctx context.Context, url string, headers Headers, requestBody ReqBodyType) (*RespBodyType, error) {
+	request, err := newJSONRequest(ctx, url, headers, requestBody)
 	if err != nil {
-		return nil, fmt.Errorf("error marshaling request body: %w", err)
+		return nil, err
 	}
 
-	response, err := http.Post(url, "application/json", bytes.NewBuffer(payload))
+	response, err := http.DefaultClient.Do(request)
 	if err != nil {
 		return nil, fmt.Errorf("http POST request failed: %w", err)
 	}
@@ -44,6 +73,33 @@ func SendPostRequest[ReqBodyType, RespBodyType any](url string, requestBody ReqB
 	return respBody, nil
 }
 
+// StreamPostRequest sends a POST request and decodes the newline-delimited JSON response body
+// chunk by chunk, calling onChunk for every decoded object until it reports the last chunk or ctx is
+// cancelled. A body ending before the last chunk is an error, as the answer is incomplete.
+func StreamPostRequest[ReqBodyType, ChunkType any](ctx context.Context, url string, requestBody ReqBodyType, onChunk func(*ChunkType) (done bool, err error)) error {
+	response, err := sendStreamRequest(ctx, url, nil, requestBody)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	decoder := json.NewDecoder(response.Body)
+	for {
+		var chunk ChunkType
+		err := decoder.Decode(&chunk)
+		if errors.Is(err, io.EOF) {
+			return errors.New("response ended before the last chunk")
+		}
+		if err != nil {
+			return fmt.Errorf("error decoding response chunk: %w", err)
+		}
+		done, err := onChunk(&chunk)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
 func extractResponseBody[RespBodyType any](response *http.Response) (*RespBodyType, error) {
 	responseBody, err := io.ReadAll(response.Body)
 	if err != nil {
@@ -63,3 +119,77 @@ func extractResponseBody[RespBodyType any](response *http.Response) (*RespBodyTy
 
 	return &respBody, nil
 }
+
+// StreamEventsPostRequest sends a POST request and decodes a server-sent events response body, as sent by
+// OpenAI-compatible APIs: onChunk is called for the JSON object of every "data:" line, until the body ends,
+// the "[DONE]" event arrives or ctx is cancelled.
+func StreamEventsPostRequest[ReqBodyType, ChunkType any](ctx context.Context, url string, headers Headers, requestBody ReqBodyType, onChunk func(*ChunkType) error) error {
+	response, err := sendStreamRequest(ctx, url, headers, requestBody)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	scanner := bufio.NewScanner(response.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue // Empty lines separate events, other fields are not used
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			return nil
+		}
+
+		var chunk ChunkType
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return fmt.Errorf("error decoding response event: %w", err)
+		}
+		if err := onChunk(&chunk); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading response events: %w", err)
+	}
+	return nil
+}
+
+// sendStreamRequest sends a POST request whose response body is read while it arrives.
+func sendStreamRequest[ReqBodyType any](ctx context.Context, url string, headers Headers, requestBody ReqBodyType) (*http.Response, error) {
+	request, err := newJSONRequest(ctx, url, headers, requestBody)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("http POST request failed: %w", err)
+	}
+
+	if response.StatusCode >= 400 {
+		responseBody, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		return nil, fmt.Errorf("HTTP error %d: %s", response.StatusCode, string(responseBody))
+	}
+	return response, nil
+}
+
+// newJSONRequest creates a POST request with the JSON encoded body and the given headers.
+func newJSONRequest[ReqBodyType any](ctx context.Context, url string, headers Headers, requestBody ReqBodyType) (*http.Request, error) {
+	payload, err := json.Marshal(requestBody)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling request body: %w", err)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+	return request, nil
+}
@@ -0,0 +1,166 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testChunk struct {
+	Token string `json:"token"`
+	Done  bool   `json:"done"`
+}
+
+// fakeStream is the answer of a fake server.
+type fakeStream struct {
+	status int           // http.StatusOK if not set
+	parts  []string      // Sent one by one, flushing after each, like Ollama streaming an answer
+	delay  time.Duration // Waited after the parts, cut short if the client gives up
+}
+
+func newFakeServer(t *testing.T, stream fakeStream) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		if stream.status != 0 {
+			w.WriteHeader(stream.status)
+		}
+		for _, part := range stream.parts {
+			w.Write([]byte(part))
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-time.After(stream.delay):
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// collectTokens returns a callback appending the tokens of the chunks to tokens.
+func collectTokens(tokens *[]string) func(chunk *testChunk) (bool, error) {
+	return func(chunk *testChunk) (bool, error) {
+		*tokens = append(*tokens, chunk.Token)
+		return chunk.Done, nil
+	}
+}
+
+func TestStreamPostRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		parts   []string
+		want    []string
+		wantErr string
+	}{
+		{
+			name:  "one chunk per line",
+			parts: []string{`{"token":"Hello"}` + "\n", `{"token":" world"}` + "\n", `{"done":true}` + "\n"},
+			want:  []string{"Hello", " world", ""},
+		},
+		{
+			name:  "chunk split across writes",
+			parts: []string{`{"tok`, `en":"a"}` + "\n" + `{"token"`, `:"b","done":true}` + "\n"},
+			want:  []string{"a", "b"},
+		},
+		{
+			name:  "several chunks in one write without trailing newline",
+			parts: []string{`{"token":"x"}` + "\n" + `{"token":"y","done":true}`},
+			want:  []string{"x", "y"},
+		},
+		{
+			name:  "chunks after the last one are not read",
+			parts: []string{`{"token":"x","done":true}` + "\n" + `{"token":"y"}` + "\n" + "not json\n"},
+			want:  []string{"x"},
+		},
+		{
+			name:    "empty body",
+			parts:   nil,
+			want:    nil,
+			wantErr: "ended before the last chunk",
+		},
+		{
+			name:    "body ending before the last chunk",
+			parts:   []string{`{"token":"Hel"}` + "\n", `{"token":"lo"}` + "\n"},
+			want:    []string{"Hel", "lo"},
+			wantErr: "ended before the last chunk",
+		},
+		{
+			name:    "malformed chunk",
+			parts:   []string{`{"token":"ok"}` + "\n", "not json\n"},
+			want:    []string{"ok"},
+			wantErr: "error decoding response chunk",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newFakeServer(t, fakeStream{parts: test.parts})
+
+			var got []string
+			err := StreamPostRequest(context.Background(), server.URL, map[string]string{}, collectTokens(&got))
+			if test.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Fatalf("error = %v, want it to contain %q", err, test.wantErr)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("tokens = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestStreamPostRequestStopsOnCallbackError(t *testing.T) {
+	server := newFakeServer(t, fakeStream{parts: []string{`{"token":"a"}` + "\n", `{"token":"b"}` + "\n"}})
+	stop := errors.New("client went away")
+
+	calls := 0
+	err := StreamPostRequest(context.Background(), server.URL, map[string]string{}, func(chunk *testChunk) (bool, error) {
+		calls++
+		return false, stop
+	})
+	if !errors.Is(err, stop) {
+		t.Fatalf("error = %v, want %v", err, stop)
+	}
+	if calls != 1 {
+		t.Errorf("callback called %d times, want 1", calls)
+	}
+}
+
+func TestStreamPostRequestHTTPError(t *testing.T) {
+	server := newFakeServer(t, fakeStream{status: http.StatusNotFound, parts: []string{`{"error":"model not found"}`}})
+
+	err := StreamPostRequest(context.Background(), server.URL, map[string]string{}, func(chunk *testChunk) (bool, error) {
+		t.Error("callback called for an error response")
+		return false, nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "HTTP error 404") || !strings.Contains(err.Error(), "model not found") {
+		t.Fatalf("error = %v, want the status and body", err)
+	}
+}
+
+func TestStreamPostRequestCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	// Hangs after the first chunk until the client gives up
+	server := newFakeServer(t, fakeStream{parts: []string{`{"token":"first"}` + "\n"}, delay: time.Minute})
+
+	var got []string
+	err := StreamPostRequest(ctx, server.URL, map[string]string{}, func(chunk *testChunk) (bool, error) {
+		got = append(got, chunk.Token)
+		cancel()
+		return false, nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("error = %v, want context.Canceled", err)
+	}
+	if !reflect.DeepEqual(got, []string{"first"}) {
+		t.Errorf("tokens = %q, want [first]", got)
+	}
+}